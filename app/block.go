@@ -0,0 +1,198 @@
+// block and mute handlers
+// A blocked user can't see, vote on or comment on the blocker's posts, and
+// the two can't follow each other. A muted user's posts are only left out
+// of the muter's feed and recommendations.
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// handler for PUT /users/:id/block
+// Body: {"id": blockerId}. Follows between the two users are removed.
+func UserBlock(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	userBlock := `
+		MATCH (u:USER {id: {uid}}), (other:USER {id: {id}})
+		MERGE (u)-[b:BLOCKS]->(other)
+		ON CREATE SET b.since=timestamp()
+		WITH u, other, b
+		OPTIONAL MATCH (u)-[f:FOLLOWS]-(other)
+		DELETE f
+		WITH DISTINCT b
+		RETURN b.since as since
+	`
+	return userRelate(context, w, r, ps, "block-user", userBlock)
+}
+
+// handler for DELETE /users/:id/block
+// Body: {"id": blockerId}
+func UserUnblock(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	userUnblock := `
+		MATCH (u:USER {id: {uid}})-[b:BLOCKS]->(other:USER {id: {id}})
+		DELETE b
+	`
+	return userUnrelate(context, w, r, ps, "unblock-user", userUnblock)
+}
+
+// handler for PUT /users/:id/mute
+// Body: {"id": muterId}
+func UserMute(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	userMute := `
+		MATCH (u:USER {id: {uid}}), (other:USER {id: {id}})
+		MERGE (u)-[m:MUTES]->(other)
+		ON CREATE SET m.since=timestamp()
+		RETURN m.since as since
+	`
+	return userRelate(context, w, r, ps, "mute-user", userMute)
+}
+
+// handler for DELETE /users/:id/mute
+// Body: {"id": muterId}
+func UserUnmute(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	userUnmute := `
+		MATCH (u:USER {id: {uid}})-[m:MUTES]->(other:USER {id: {id}})
+		DELETE m
+	`
+	return userUnrelate(context, w, r, ps, "unmute-user", userUnmute)
+}
+
+type UserRel struct {
+	Since int `json:"since"`
+}
+
+// Read the id of the acting user from the body, `{"id": userId}`
+func relatingUserId(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (string, error) {
+	var props UserIdRequest
+	err := decodeBody(w, r, &props)
+	if err != nil {
+		return "", err
+	}
+	if props.Id == ps.ByName("id") {
+		return "", BadRequest("users cannot block or mute themselves")
+	}
+	return props.Id, nil
+}
+
+// Run `statement` relating the user in the body, `{uid}`, to user `:id`.
+// The statement returns the `since` of the relationship.
+func userRelate(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params, name string, statement string) (int, error) {
+	uid, err := relatingUserId(w, r, ps)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	queryReqUserRelate := QueryRequest{
+		Name:   name,
+		Result: &[]UserRel{},
+		Query:  MakeQuery(statement, Props{"uid": uid, "id": ps.ByName("id")}, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqUserRelate, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	rows := *result.Result.(*[]UserRel)
+	if len(rows) == 0 {
+		return http.StatusNotFound, NotFound("user")
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(rows[0])
+}
+
+// Run `statement` removing the relationship from the user in the body,
+// `{uid}`, to user `:id`
+func userUnrelate(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params, name string, statement string) (int, error) {
+	uid, err := relatingUserId(w, r, ps)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	queryReqUserUnrelate := QueryRequest{
+		Name:   name,
+		Result: nil,
+		Query:  MakeQuery(statement, Props{"uid": uid, "id": ps.ByName("id")}, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqUserUnrelate, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return noContent(w)
+}
+
+// handler for GET /users/:id/blocks
+// Only visible to the user `:id` (`X-User-Id`)
+func UserGetBlocked(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	userGetBlocked := `
+		MATCH (u:USER {id: {id}})-[b:BLOCKS]->(other:USER)
+		RETURN other.id as id, other.name as name, b.since as since
+		ORDER BY b.since DESC
+		SKIP {skip}
+		LIMIT {limit}
+	`
+	if callerId(r) != ps.ByName("id") {
+		return http.StatusForbidden, Forbidden("blocked users are only visible to their owner")
+	}
+	return userGetFollows(context, w, r, ps, "get-user-blocks", userGetBlocked)
+}
+
+// handler for GET /users/:id/mutes
+// Only visible to the user `:id` (`X-User-Id`)
+func UserGetMuted(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	userGetMuted := `
+		MATCH (u:USER {id: {id}})-[m:MUTES]->(other:USER)
+		RETURN other.id as id, other.name as name, m.since as since
+		ORDER BY m.since DESC
+		SKIP {skip}
+		LIMIT {limit}
+	`
+	if callerId(r) != ps.ByName("id") {
+		return http.StatusForbidden, Forbidden("muted users are only visible to their owner")
+	}
+	return userGetFollows(context, w, r, ps, "get-user-mutes", userGetMuted)
+}
+
+// Whether the author of post `postId` blocks user `userId`
+func postAuthorBlocks(context *AppContext, postId string, userId string) (bool, error) {
+	authorBlocks := `
+		MATCH (author:USER)-[:CREATED]->(:POST {id: {postId}}),
+		(author)-[:BLOCKS]->(:USER {id: {userId}})
+		RETURN author.id as id
+	`
+	return anyRow(context, "post-author-blocks", authorBlocks, Props{"postId": postId, "userId": userId})
+}
+
+// Whether either of two users blocks the other
+func eitherBlocks(context *AppContext, a string, b string) (bool, error) {
+	usersBlock := `
+		MATCH (a:USER {id: {a}})-[:BLOCKS]-(b:USER {id: {b}})
+		RETURN a.id as id
+	`
+	return anyRow(context, "users-block", usersBlock, Props{"a": a, "b": b})
+}
+
+// Whether `statement`, returning an `id` column, matches anything
+func anyRow(context *AppContext, name string, statement string, params Props) (bool, error) {
+	queryReqAnyRow := QueryRequest{
+		Name: name,
+		Result: &[]struct {
+			Id string `json:"id"`
+		}{},
+		Query: MakeQuery(statement, params, nil),
+	}
+
+	result := QueryResult{}
+	err := context.DB.RunSingleQuery(queryReqAnyRow, &result)
+	if err != nil {
+		return false, err
+	}
+	return len(*result.Result.(*[]struct {
+		Id string `json:"id"`
+	})) > 0, nil
+}
@@ -0,0 +1,167 @@
+// bookmark handlers
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Collection of posts saved without naming one
+const defaultCollection = "default"
+
+type SavedPost struct {
+	Id          string `json:"id"`
+	Title       string `json:"title"`
+	Type        string `json:"type"`
+	Author      string `json:"author"`
+	PublishDate int    `json:"publishDate"`
+	SavedAt     int    `json:"savedAt"`
+}
+
+// A named collection of saved posts. `Total` counts all of its posts,
+// `Posts` holds the requested page of them.
+type SavedCollection struct {
+	Name  string      `json:"name"`
+	Total int         `json:"total"`
+	Posts []SavedPost `json:"posts"`
+}
+
+// handler for PUT /posts/:id/save
+// Saved by the user `X-User-Id`. Body: {"collection": name}, optional.
+// Saving a post again moves it to the given collection.
+func PostSave(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	caller := callerId(r)
+	if caller == "" {
+		return http.StatusUnauthorized, Unauthorized("X-User-Id header required")
+	}
+	var props SaveRequest
+	err := decodeOptionalBody(w, r, &props)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if props.Collection == "" {
+		props.Collection = defaultCollection
+	}
+	blocked, err := postAuthorBlocks(context, ps.ByName("id"), caller)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if blocked {
+		return http.StatusForbidden, Forbidden("blocked by the post's author")
+	}
+
+	postSave := `
+		MATCH (u:USER {id: {uid}}), (author:USER)-[:CREATED]->(p:POST {id: {id}})
+		WHERE coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR author = u
+		MERGE (u)-[s:SAVED]->(p)
+		ON CREATE SET s.at = timestamp()
+		SET s.collection = {collection}
+		RETURN p.id as id, p.title as title, p.type as type, author.id as author,
+		p.publishDate as publishDate, s.at as savedAt
+	`
+	queryReqPostSave := QueryRequest{
+		Name:   "save-post",
+		Result: &[]SavedPost{},
+		Query: MakeQuery(postSave, Props{
+			"uid":        caller,
+			"id":         ps.ByName("id"),
+			"collection": props.Collection,
+		}, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqPostSave, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	saved := *result.Result.(*[]SavedPost)
+	if len(saved) == 0 {
+		return http.StatusNotFound, NotFound("user or post")
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(saved[0])
+}
+
+// handler for DELETE /posts/:id/save
+// Unsaved by the user `X-User-Id`
+func PostUnsave(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	caller := callerId(r)
+	if caller == "" {
+		return http.StatusUnauthorized, Unauthorized("X-User-Id header required")
+	}
+
+	postUnsave := `
+		MATCH (u:USER {id: {uid}})-[s:SAVED]->(p:POST {id: {id}})
+		DELETE s
+	`
+	queryReqPostUnsave := QueryRequest{
+		Name:   "unsave-post",
+		Result: nil,
+		Query:  MakeQuery(postUnsave, Props{"uid": caller, "id": ps.ByName("id")}, nil),
+	}
+
+	result := QueryResult{}
+	err := context.DB.RunSingleQuery(queryReqPostUnsave, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return noContent(w)
+}
+
+// handler for GET /users/:id/saved
+// Saved posts grouped by collection, most recently saved first. `skip`
+// and `limit` page through each collection, `collection` picks one.
+// Only visible to the user `:id` (`X-User-Id`).
+func UserGetSaved(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	caller := callerId(r)
+	if caller == "" {
+		return http.StatusUnauthorized, Unauthorized("X-User-Id header required")
+	}
+	if caller != ps.ByName("id") {
+		return http.StatusForbidden, Forbidden("saved posts are only visible to their owner")
+	}
+	skip, limit, err := pageParams(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	var collection interface{}
+	if c := r.URL.Query().Get("collection"); c != "" {
+		collection = c
+	}
+
+	userGetSaved := `
+		MATCH (me:USER {id: {id}})-[s:SAVED]->(p:POST)<-[:CREATED]-(author:USER)
+		WHERE ({collection} IS NULL OR s.collection = {collection})
+		AND (coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR author = me)
+		AND NOT (author)-[:BLOCKS]->(me)
+		WITH s, p, author
+		ORDER BY s.at DESC
+		WITH s.collection as name, collect({
+			id: p.id, title: p.title, type: p.type, author: author.id,
+			publishDate: p.publishDate, savedAt: s.at
+		}) as posts
+		RETURN name, size(posts) as total, posts[{skip}..{skip} + {limit}] as posts
+		ORDER BY name
+	`
+	queryReqUserGetSaved := QueryRequest{
+		Name:   "user-get-saved",
+		Result: &[]SavedCollection{},
+		Query: MakeQuery(userGetSaved, Props{
+			"id":         ps.ByName("id"),
+			"collection": collection,
+			"skip":       skip,
+			"limit":      limit,
+		}, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqUserGetSaved, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
+}
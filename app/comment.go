@@ -0,0 +1,375 @@
+// comment handlers
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// default and maximum depth of comment threads
+	defaultCommentDepth = 3
+	maxCommentDepth     = 10
+)
+
+// Comments are stored as (USER)-[:WROTE]->(COMMENT)-[:ON]->(POST), replies
+// are linked to the comment they answer with (COMMENT)-[:REPLY_TO]->(COMMENT)
+type Comment struct {
+	Id               string     `json:"id"`
+	Post             string     `json:"post"`
+	Parent           string     `json:"parent,omitempty"`
+	Author           string     `json:"author"`
+	Body             string     `json:"body"`
+	Deleted          bool       `json:"deleted"`
+	Upvotes          int        `json:"upvotes"`
+	Downvotes        int        `json:"downvotes"`
+	CreateTime       int        `json:"createTime"`
+	LastModifiedTime int        `json:"lastModifiedTime"`
+	Level            int        `json:"level"`
+	ReplyCount       int        `json:"replyCount"`
+	Replies          []*Comment `json:"replies,omitempty"`
+}
+
+// Arrange comments into threads. Comments whose parent is not in the list
+// are left out.
+func buildCommentThreads(comments []Comment) []*Comment {
+	byId := make(map[string]*Comment, len(comments))
+	for i := range comments {
+		byId[comments[i].Id] = &comments[i]
+	}
+	roots := []*Comment{}
+	for i := range comments {
+		c := &comments[i]
+		if c.Parent == "" {
+			roots = append(roots, c)
+		} else if parent, ok := byId[c.Parent]; ok {
+			parent.Replies = append(parent.Replies, c)
+		}
+	}
+	return roots
+}
+
+// handler for GET /posts/:id/comments
+// Returns the comment threads of a post, `depth` limits how many levels of
+// replies are included.
+func CommentGetAll(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	r.ParseForm()
+	depth := defaultCommentDepth
+	if d := r.Form.Get("depth"); d != "" {
+		var err error
+		depth, err = strconv.Atoi(d)
+		if err != nil || depth < 1 || depth > maxCommentDepth {
+			return http.StatusBadRequest, BadRequest("depth must be between 1 and " + strconv.Itoa(maxCommentDepth))
+		}
+	}
+
+	commentGetAll := `
+		MATCH (postAuthor:USER)-[:CREATED]->(p:POST {id:{id}})
+		WHERE (coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR postAuthor.id = {caller})
+		AND NOT (postAuthor)-[:BLOCKS]->(:USER {id: {caller}})
+		MATCH path=(p)<-[:ON]-(c:COMMENT)-[:REPLY_TO*0..]->(root:COMMENT)
+		WHERE NOT (root)-[:REPLY_TO]->()
+		WITH p, c, length(path) - 1 as level
+		WHERE level < {depth}
+		MATCH (author:USER)-[:WROTE]->(c)
+		OPTIONAL MATCH (c)-[:REPLY_TO]->(parent:COMMENT)
+		RETURN c.id as id, p.id as post, parent.id as parent, author.id as author,
+		c.body as body, coalesce(c.deleted, false) as deleted,
+		c.upvotes as upvotes, c.downvotes as downvotes,
+		c.createTime as createTime, c.lastModifiedTime as lastModifiedTime,
+		level, size((c)<-[:REPLY_TO]-()) as replyCount
+		ORDER BY level, c.createTime
+	`
+	queryReqCommentGetAll := QueryRequest{
+		Name:   "comment-get-all",
+		Result: &[]Comment{},
+		Query: MakeQuery(
+			commentGetAll,
+			Props{"id": ps.ByName("id"), "caller": callerId(r), "depth": depth},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err := context.DB.RunSingleQuery(queryReqCommentGetAll, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	threads := buildCommentThreads(*result.Result.(*[]Comment))
+	return http.StatusOK, json.NewEncoder(w).Encode(threads)
+}
+
+// handler for GET /posts/:id/comments/:cid
+func CommentGetOne(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	commentFindById := `
+		MATCH (postAuthor:USER)-[:CREATED]->(p:POST {id:{id}})<-[:ON]-(c:COMMENT {id:{cid}})
+		WHERE (coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR postAuthor.id = {caller})
+		AND NOT (postAuthor)-[:BLOCKS]->(:USER {id: {caller}})
+		MATCH (author:USER)-[:WROTE]->(c)
+		OPTIONAL MATCH (c)-[:REPLY_TO]->(parent:COMMENT)
+		RETURN c.id as id, p.id as post, parent.id as parent, author.id as author,
+		c.body as body, coalesce(c.deleted, false) as deleted,
+		c.upvotes as upvotes, c.downvotes as downvotes,
+		c.createTime as createTime, c.lastModifiedTime as lastModifiedTime,
+		size((c)<-[:REPLY_TO]-()) as replyCount
+	`
+	queryReqCommentFindById := QueryRequest{
+		Name:   "find-comment-by-id",
+		Result: &[]Comment{},
+		Query: MakeQuery(
+			commentFindById,
+			Props{"id": ps.ByName("id"), "cid": ps.ByName("cid"), "caller": callerId(r)},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err := context.DB.RunSingleQuery(queryReqCommentFindById, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	comments := *result.Result.(*[]Comment)
+	if len(comments) == 0 {
+		return http.StatusNotFound, NotFound("comment")
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(comments[0])
+}
+
+// handler for POST /posts/:id/comments
+// Body: {"author": userId, "body": text, "parent": commentId}, `parent` is
+// only given for replies. Only published posts can be commented on.
+func CommentCreate(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	var props CommentRequest
+	err := decodeBody(w, r, &props)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	blocked, err := postAuthorBlocks(context, ps.ByName("id"), props.Author)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if blocked {
+		return http.StatusForbidden, Forbidden("blocked by the post's author")
+	}
+	suspended, err := userSuspended(context, props.Author)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if suspended {
+		return http.StatusForbidden, Forbidden("suspended users cannot comment")
+	}
+
+	commentCreate := `
+		MATCH (author:USER {id:{uid}}), (p:POST {id:{id}})
+		WHERE coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false)
+		OPTIONAL MATCH (parent:COMMENT {id:{parent}})-[:ON]->(p)
+		WITH author, p, parent
+		WHERE {parent} = '' OR parent IS NOT NULL
+		CREATE (author)-[:WROTE]->(c:COMMENT {id:{cid}, body:{body},
+			upvotes:0, downvotes:0, createTime:timestamp()})-[:ON]->(p)
+		FOREACH (reply IN CASE WHEN parent IS NULL THEN [] ELSE [parent] END |
+			CREATE (c)-[:REPLY_TO]->(reply))
+		RETURN c.id as id, p.id as post, parent.id as parent, author.id as author,
+		c.body as body, false as deleted, c.upvotes as upvotes,
+		c.downvotes as downvotes, c.createTime as createTime, 0 as replyCount
+	`
+	queryReqCommentCreate := QueryRequest{
+		Name:   "create-comment",
+		Result: &[]Comment{},
+		Query: MakeQuery(commentCreate, Props{
+			"uid":    props.Author,
+			"id":     ps.ByName("id"),
+			"cid":    newId(),
+			"body":   props.Body,
+			"parent": props.Parent,
+		}, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqCommentCreate, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	comments := *result.Result.(*[]Comment)
+	if len(comments) == 0 {
+		return http.StatusNotFound, NotFound("author, published post or parent comment")
+	}
+
+	return http.StatusCreated, json.NewEncoder(w).Encode(comments[0])
+}
+
+// handler for PUT /posts/:id/comments/:cid
+// Only the body of a comment can be changed.
+func CommentUpdate(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	var props CommentUpdateRequest
+	err := decodeBody(w, r, &props)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	commentUpdate := `
+		MATCH (author:USER)-[:WROTE]->(c:COMMENT {id:{cid}})-[:ON]->(p:POST {id:{id}})
+		WHERE NOT coalesce(c.deleted, false)
+		SET c.body = {body}, c.lastModifiedTime = timestamp()
+		WITH author, c, p
+		OPTIONAL MATCH (c)-[:REPLY_TO]->(parent:COMMENT)
+		RETURN c.id as id, p.id as post, parent.id as parent, author.id as author,
+		c.body as body, false as deleted, c.upvotes as upvotes,
+		c.downvotes as downvotes, c.createTime as createTime,
+		c.lastModifiedTime as lastModifiedTime,
+		size((c)<-[:REPLY_TO]-()) as replyCount
+	`
+	queryReqCommentUpdate := QueryRequest{
+		Name:   "update-comment",
+		Result: &[]Comment{},
+		Query: MakeQuery(
+			commentUpdate,
+			Props{"id": ps.ByName("id"), "cid": ps.ByName("cid"), "body": props.Body},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqCommentUpdate, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	comments := *result.Result.(*[]Comment)
+	if len(comments) == 0 {
+		return http.StatusNotFound, NotFound("comment")
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(comments[0])
+}
+
+// handler for DELETE /posts/:id/comments/:cid
+// A comment with replies is only blanked out so the thread stays intact.
+func CommentDestroy(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	commentDestroy := `
+		MATCH (c:COMMENT {id:{cid}})-[:ON]->(:POST {id:{id}})
+		WITH c, size((c)<-[:REPLY_TO]-()) as replies
+		FOREACH (_ IN CASE WHEN replies > 0 THEN [1] ELSE [] END |
+			SET c.deleted = true, c.body = null, c.lastModifiedTime = timestamp())
+		FOREACH (_ IN CASE WHEN replies = 0 THEN [1] ELSE [] END |
+			DETACH DELETE c)
+		RETURN replies
+	`
+	queryReqCommentDestroy := QueryRequest{
+		Name: "delete-comment",
+		Result: &[]struct {
+			Replies int `json:"replies"`
+		}{},
+		Query: MakeQuery(
+			commentDestroy,
+			Props{"id": ps.ByName("id"), "cid": ps.ByName("cid")},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err := context.DB.RunSingleQuery(queryReqCommentDestroy, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if len(*result.Result.(*[]struct {
+		Replies int `json:"replies"`
+	})) == 0 {
+		return http.StatusNotFound, NotFound("comment")
+	}
+
+	return noContent(w)
+}
+
+// handler for PUT /posts/:id/comments/:cid/vote
+// Body: {"id": userId, "down": bool}
+func CommentVote(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	var props CommentVoteRequest
+	err := decodeBody(w, r, &props)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	blocked, err := postAuthorBlocks(context, ps.ByName("id"), props.Id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if blocked {
+		return http.StatusForbidden, Forbidden("blocked by the post's author")
+	}
+	suspended, err := userSuspended(context, props.Id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if suspended {
+		return http.StatusForbidden, Forbidden("suspended users cannot vote")
+	}
+
+	commentVote := `
+		MATCH (u:USER {id: {uid}}), (c:COMMENT {id: {cid}})-[:ON]->(:POST {id: {id}})
+		MERGE (u)-[r:VOTED]->(c)
+		ON CREATE SET r.created=timestamp(), r.found=false, r.down={down},
+		c.upvotes=c.upvotes + CASE WHEN {down} THEN 0 ELSE 1 END,
+		c.downvotes=c.downvotes + CASE WHEN {down} THEN 1 ELSE 0 END
+		ON MATCH SET r.found=true
+		RETURN r.created as created, r.found as found
+	`
+	queryReqCommentVote := QueryRequest{
+		Name:   "vote-comment",
+		Result: &[]VoteRel{},
+		Query: MakeQuery(commentVote, Props{
+			"uid":  props.Id,
+			"id":   ps.ByName("id"),
+			"cid":  ps.ByName("cid"),
+			"down": props.Down,
+		}, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqCommentVote, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if len(*result.Result.(*[]VoteRel)) == 0 {
+		return http.StatusNotFound, NotFound("user or comment")
+	}
+
+	return noContent(w)
+}
+
+// handler for DELETE /posts/:id/comments/:cid/vote
+// Body: {"id": userId}
+func CommentDeleteVote(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	var props VoteRequest
+	err := decodeBody(w, r, &props)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	commentDeleteVote := `
+		MATCH (u:USER {id: {uid}})-[r:VOTED]->(c:COMMENT {id: {cid}})-[:ON]->(:POST {id: {id}})
+		SET c.upvotes=c.upvotes - CASE WHEN r.down THEN 0 ELSE 1 END,
+		c.downvotes=c.downvotes - CASE WHEN r.down THEN 1 ELSE 0 END
+		DELETE r
+	`
+	queryReqCommentDeleteVote := QueryRequest{
+		Name:   "delete-comment-vote",
+		Result: nil,
+		Query: MakeQuery(
+			commentDeleteVote,
+			Props{"uid": props.Id, "id": ps.ByName("id"), "cid": ps.ByName("cid")},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqCommentDeleteVote, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return noContent(w)
+}
@@ -0,0 +1,491 @@
+// server configuration
+// Settings are read, from lowest to highest precedence, from the defaults,
+// a YAML or TOML file (`-config` or WOK_CONFIG), environment variables and
+// command-line flags. Each setting has a dotted name, Ex. `db.uri`, which is
+// also its flag, `-db.uri`, and its variable, WOK_DB_URI.
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	DB        DBConfig        `yaml:"db" toml:"db"`
+	Server    ServerConfig    `yaml:"server" toml:"server"`
+	Log       LogConfig       `yaml:"log" toml:"log"`
+	Tracing   TracingConfig   `yaml:"tracing" toml:"tracing"`
+	RateLimit RateLimitConfig `yaml:"rateLimit" toml:"rateLimit"`
+	Features  FeatureConfig   `yaml:"features" toml:"features"`
+}
+
+type DBConfig struct {
+	// Neo4j REST endpoint, without credentials
+	URI      string `yaml:"uri" toml:"uri"`
+	User     string `yaml:"user" toml:"user"`
+	Password string `yaml:"password" toml:"password"`
+	// How long to wait for Neo4j to answer a request
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+	// Idle connections kept open to Neo4j
+	MaxIdleConns int `yaml:"maxIdleConns" toml:"maxIdleConns"`
+	// How long to keep retrying to connect at startup
+	ConnectTimeout time.Duration `yaml:"connectTimeout" toml:"connectTimeout"`
+}
+
+type ServerConfig struct {
+	Addr            string        `yaml:"addr" toml:"addr"`
+	ReadTimeout     time.Duration `yaml:"readTimeout" toml:"readTimeout"`
+	WriteTimeout    time.Duration `yaml:"writeTimeout" toml:"writeTimeout"`
+	IdleTimeout     time.Duration `yaml:"idleTimeout" toml:"idleTimeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" toml:"shutdownTimeout"`
+	// Largest request body accepted
+	MaxBodyBytes int `yaml:"maxBodyBytes" toml:"maxBodyBytes"`
+	// Redoc bundle of the /docs page and its Subresource Integrity hash
+	DocsScript    string `yaml:"docsScript" toml:"docsScript"`
+	DocsIntegrity string `yaml:"docsIntegrity" toml:"docsIntegrity"`
+}
+
+type LogConfig struct {
+	// debug, info, warn or error
+	Level string `yaml:"level" toml:"level"`
+	// Fields whose values are never logged
+	Redact []string `yaml:"redact" toml:"redact"`
+}
+
+type TracingConfig struct {
+	// none, stdout or otlp
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	// host:port of the OTLP/HTTP collector
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	// Send to the collector without TLS
+	Insecure bool `yaml:"insecure" toml:"insecure"`
+	// Fraction of new traces sampled, traces started by a caller follow
+	// the caller's choice
+	SampleRatio float64 `yaml:"sampleRatio" toml:"sampleRatio"`
+}
+
+type RateLimitConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// Take the client address from X-Forwarded-For, only behind a proxy
+	// setting it
+	TrustProxy bool `yaml:"trustProxy" toml:"trustProxy"`
+	// API keys whose clients are limited by key rather than address
+	APIKeys []string `yaml:"apiKeys" toml:"apiKeys"`
+	// Clients whose buckets are kept in memory
+	MaxClients int               `yaml:"maxClients" toml:"maxClients"`
+	Policies   []RateLimitPolicy `yaml:"policies" toml:"policies"`
+}
+
+type RateLimitPolicy struct {
+	Name string `yaml:"name" toml:"name"`
+	// Routes as registered, Ex. "PUT /posts/:id/vote", "*" for the routes
+	// of no other policy
+	Routes []string `yaml:"routes" toml:"routes"`
+	// Requests allowed every `Period`
+	Limit  int           `yaml:"limit" toml:"limit"`
+	Period time.Duration `yaml:"period" toml:"period"`
+	// Requests allowed at once, `Limit` if 0
+	Burst int `yaml:"burst" toml:"burst"`
+	// What clients are told apart by: auto, the default, takes their
+	// X-API-Key when it's one of `APIKeys` and their address otherwise,
+	// ip only their address
+	Key string `yaml:"key" toml:"key"`
+}
+
+func (p *RateLimitPolicy) burst() int {
+	if p.Burst == 0 {
+		return p.Limit
+	}
+	return p.Burst
+}
+
+type FeatureConfig struct {
+	// Publish scheduled posts every `SchedulerInterval`
+	Scheduler         bool          `yaml:"scheduler" toml:"scheduler"`
+	SchedulerInterval time.Duration `yaml:"schedulerInterval" toml:"schedulerInterval"`
+	// Open reports hiding a post, 0 turns automatic hiding off
+	ReportHideThreshold int `yaml:"reportHideThreshold" toml:"reportHideThreshold"`
+}
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+func DefaultConfig() *Config {
+	return &Config{
+		DB: DBConfig{
+			URI:            "http://localhost:7474/db/data",
+			User:           "neo4j",
+			Timeout:        10 * time.Second,
+			MaxIdleConns:   16,
+			ConnectTimeout: time.Minute,
+		},
+		Server: ServerConfig{
+			Addr:            ":8888",
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 20 * time.Second,
+			MaxBodyBytes:    int(MaxBodyBytes),
+			DocsScript:      DocsScript,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Redact: RedactedFields,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			Endpoint:    "localhost:4318",
+			Insecure:    true,
+			SampleRatio: 1,
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:    true,
+			MaxClients: 100000,
+			Policies: []RateLimitPolicy{
+				{
+					Name:   "votes",
+					Routes: []string{"PUT /posts/:id/vote", "DELETE /posts/:id/vote", "PUT /posts/:id/comments/:cid/vote", "DELETE /posts/:id/comments/:cid/vote"},
+					Limit:  30,
+					Period: time.Minute,
+				},
+				{
+					Name:   "posts",
+					Routes: []string{"POST /posts"},
+					Limit:  10,
+					Period: time.Hour,
+				},
+				{
+					Name:   "comments",
+					Routes: []string{"POST /posts/:id/comments"},
+					Limit:  60,
+					Period: time.Hour,
+				},
+				{
+					Name:   "reports",
+					Routes: []string{"POST /posts/:id/report", "POST /users/:id/report"},
+					Limit:  20,
+					Period: time.Hour,
+				},
+			},
+		},
+		Features: FeatureConfig{
+			Scheduler:           true,
+			SchedulerInterval:   time.Minute,
+			ReportHideThreshold: ReportHideThreshold,
+		},
+	}
+}
+
+// A setting that can be given by flag or environment variable
+type setting struct {
+	name  string
+	usage string
+	field func(*Config) interface{}
+}
+
+var settings = []setting{
+	{"db.uri", "Neo4j REST endpoint", func(c *Config) interface{} { return &c.DB.URI }},
+	{"db.user", "Neo4j user", func(c *Config) interface{} { return &c.DB.User }},
+	{"db.password", "Neo4j password", func(c *Config) interface{} { return &c.DB.Password }},
+	{"db.timeout", "Neo4j request timeout", func(c *Config) interface{} { return &c.DB.Timeout }},
+	{"db.maxIdleConns", "idle connections kept to Neo4j", func(c *Config) interface{} { return &c.DB.MaxIdleConns }},
+	{"db.connectTimeout", "how long to retry connecting at startup", func(c *Config) interface{} { return &c.DB.ConnectTimeout }},
+	{"server.addr", "address to listen on", func(c *Config) interface{} { return &c.Server.Addr }},
+	{"server.readTimeout", "timeout reading a request", func(c *Config) interface{} { return &c.Server.ReadTimeout }},
+	{"server.writeTimeout", "timeout writing a response", func(c *Config) interface{} { return &c.Server.WriteTimeout }},
+	{"server.idleTimeout", "timeout of idle keep-alive connections", func(c *Config) interface{} { return &c.Server.IdleTimeout }},
+	{"server.shutdownTimeout", "time given to requests to finish on shutdown", func(c *Config) interface{} { return &c.Server.ShutdownTimeout }},
+	{"server.maxBodyBytes", "largest request body accepted", func(c *Config) interface{} { return &c.Server.MaxBodyBytes }},
+	{"server.docsScript", "URL of the Redoc bundle of /docs", func(c *Config) interface{} { return &c.Server.DocsScript }},
+	{"server.docsIntegrity", "Subresource Integrity hash of server.docsScript", func(c *Config) interface{} { return &c.Server.DocsIntegrity }},
+	{"log.level", "debug, info, warn or error", func(c *Config) interface{} { return &c.Log.Level }},
+	{"log.redact", "comma separated fields whose values are never logged", func(c *Config) interface{} { return &c.Log.Redact }},
+	{"tracing.exporter", "none, stdout or otlp", func(c *Config) interface{} { return &c.Tracing.Exporter }},
+	{"tracing.endpoint", "host:port of the OTLP/HTTP collector", func(c *Config) interface{} { return &c.Tracing.Endpoint }},
+	{"tracing.insecure", "send to the collector without TLS", func(c *Config) interface{} { return &c.Tracing.Insecure }},
+	{"tracing.sampleRatio", "fraction of new traces sampled", func(c *Config) interface{} { return &c.Tracing.SampleRatio }},
+	{"rateLimit.enabled", "limit requests by the rate limit policies", func(c *Config) interface{} { return &c.RateLimit.Enabled }},
+	{"rateLimit.trustProxy", "take the client address from X-Forwarded-For", func(c *Config) interface{} { return &c.RateLimit.TrustProxy }},
+	{"rateLimit.apiKeys", "comma separated API keys limited by key", func(c *Config) interface{} { return &c.RateLimit.APIKeys }},
+	{"rateLimit.maxClients", "clients whose buckets are kept in memory", func(c *Config) interface{} { return &c.RateLimit.MaxClients }},
+	{"features.scheduler", "publish scheduled posts", func(c *Config) interface{} { return &c.Features.Scheduler }},
+	{"features.schedulerInterval", "how often to publish scheduled posts", func(c *Config) interface{} { return &c.Features.SchedulerInterval }},
+	{"features.reportHideThreshold", "open reports hiding a post, 0 for never", func(c *Config) interface{} { return &c.Features.ReportHideThreshold }},
+}
+
+// Environment variable of setting `name`, Ex. db.maxIdleConns -> WOK_DB_MAX_IDLE_CONNS
+func settingEnv(name string) string {
+	var b strings.Builder
+	b.WriteString("WOK_")
+	for i, c := range name {
+		switch {
+		case c == '.':
+			b.WriteByte('_')
+		case c >= 'A' && c <= 'Z':
+			if i > 0 && name[i-1] != '.' {
+				b.WriteByte('_')
+			}
+			b.WriteRune(c)
+		default:
+			b.WriteString(strings.ToUpper(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// Parse `s` into the setting field `field` points to
+func setField(field interface{}, s string) error {
+	switch f := field.(type) {
+	case *string:
+		*f = s
+	case *[]string:
+		*f = nil
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				*f = append(*f, e)
+			}
+		}
+	case *int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		*f = n
+	case *float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return errors.New("not a number")
+		}
+		*f = n
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("not a boolean")
+		}
+		*f = b
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.New("not a duration, Ex. 30s")
+		}
+		*f = d
+	}
+	return nil
+}
+
+// Load the configuration from the file, environment and command-line
+// arguments `args` (without the program name), then validate it
+func LoadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("wok", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("WOK_CONFIG"), "YAML or TOML config file")
+	flags := map[string]string{}
+	for _, s := range settings {
+		name := s.name
+		fs.Func(name, s.usage+" ("+settingEnv(name)+")", func(v string) error {
+			flags[name] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	config := DefaultConfig()
+	if *configFile != "" {
+		if err := config.readFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(settingEnv(s.name)); ok {
+			if err := setField(s.field(config), v); err != nil {
+				return nil, fmt.Errorf("config: %s: %v", settingEnv(s.name), err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := flags[s.name]; ok {
+			if err := setField(s.field(config), v); err != nil {
+				return nil, fmt.Errorf("config: -%s: %v", s.name, err)
+			}
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Read the YAML or TOML file `path` over the current settings, unknown
+// keys are an error
+func (c *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if err == nil {
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				err = fmt.Errorf("unknown key %s", undecoded[0])
+			}
+		}
+	default:
+		err = errors.New("unknown format, use .yaml, .yml or .toml")
+	}
+	if err != nil {
+		return fmt.Errorf("config: %s: %v", path, err)
+	}
+	return nil
+}
+
+// Check the settings, reporting every invalid one
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(name string, format string, a ...interface{}) {
+		problems = append(problems, name+": "+fmt.Sprintf(format, a...))
+	}
+
+	if u, err := url.Parse(c.DB.URI); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		invalid("db.uri", "must be an http(s) URL, got %q", c.DB.URI)
+	} else if u.User != nil {
+		invalid("db.uri", "must not hold credentials, use db.user and db.password")
+	}
+	if c.DB.Timeout <= 0 {
+		invalid("db.timeout", "must be positive")
+	}
+	if c.DB.ConnectTimeout <= 0 {
+		invalid("db.connectTimeout", "must be positive")
+	}
+	if c.DB.MaxIdleConns < 0 {
+		invalid("db.maxIdleConns", "must not be negative")
+	}
+	if _, _, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		invalid("server.addr", "must be host:port, got %q", c.Server.Addr)
+	}
+	for name, d := range map[string]time.Duration{
+		"server.readTimeout":     c.Server.ReadTimeout,
+		"server.writeTimeout":    c.Server.WriteTimeout,
+		"server.idleTimeout":     c.Server.IdleTimeout,
+		"server.shutdownTimeout": c.Server.ShutdownTimeout,
+	} {
+		if d <= 0 {
+			invalid(name, "must be positive")
+		}
+	}
+	if c.Server.MaxBodyBytes <= 0 {
+		invalid("server.maxBodyBytes", "must be positive")
+	}
+	if c.Server.DocsScript == "" {
+		invalid("server.docsScript", "must be set")
+	}
+	for _, hash := range strings.Fields(c.Server.DocsIntegrity) {
+		if !strings.HasPrefix(hash, "sha256-") && !strings.HasPrefix(hash, "sha384-") && !strings.HasPrefix(hash, "sha512-") {
+			invalid("server.docsIntegrity", "must be sha256-, sha384- or sha512- hashes, got %q", hash)
+		}
+	}
+	if !contains(logLevels, c.Log.Level) {
+		invalid("log.level", "must be one of %v, got %q", logLevels, c.Log.Level)
+	}
+	if !contains(tracingExporters, c.Tracing.Exporter) {
+		invalid("tracing.exporter", "must be one of %v, got %q", tracingExporters, c.Tracing.Exporter)
+	}
+	if c.Tracing.Exporter == "otlp" && c.Tracing.Endpoint == "" {
+		invalid("tracing.endpoint", "must be set for the otlp exporter")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		invalid("tracing.sampleRatio", "must be between 0 and 1")
+	}
+	if c.RateLimit.MaxClients <= 0 {
+		invalid("rateLimit.maxClients", "must be positive")
+	}
+	names := map[string]bool{}
+	routes := map[string]string{}
+	for i, p := range c.RateLimit.Policies {
+		name := fmt.Sprintf("rateLimit.policies[%d]", i)
+		if p.Name == "" {
+			invalid(name+".name", "must be set")
+		} else if names[p.Name] {
+			invalid(name+".name", "%q is used twice", p.Name)
+		}
+		names[p.Name] = true
+		if len(p.Routes) == 0 {
+			invalid(name+".routes", "must not be empty")
+		}
+		for _, route := range p.Routes {
+			if fields := strings.Fields(route); route != "*" && (len(fields) != 2 || !strings.HasPrefix(fields[1], "/")) {
+				invalid(name+".routes", "must be \"METHOD /path\" or \"*\", got %q", route)
+			} else if other, ok := routes[route]; ok {
+				invalid(name+".routes", "%s is also limited by %s", route, other)
+			}
+			routes[route] = p.Name
+		}
+		if p.Limit <= 0 {
+			invalid(name+".limit", "must be positive")
+		}
+		if p.Period <= 0 {
+			invalid(name+".period", "must be positive")
+		}
+		if p.Burst < 0 {
+			invalid(name+".burst", "must not be negative")
+		}
+		if p.Key != "" && !contains(rateLimitKeys, p.Key) {
+			invalid(name+".key", "must be one of %v, got %q", rateLimitKeys, p.Key)
+		}
+	}
+	if c.Features.Scheduler && c.Features.SchedulerInterval <= 0 {
+		invalid("features.schedulerInterval", "must be positive")
+	}
+	if c.Features.ReportHideThreshold < 0 {
+		invalid("features.reportHideThreshold", "must not be negative")
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// The Neo4j endpoint with the credentials filled in
+func (c *DBConfig) ConnectURI() string {
+	u, err := url.Parse(c.URI)
+	if err != nil {
+		return c.URI
+	}
+	if c.User != "" {
+		u.User = url.UserPassword(c.User, c.Password)
+	}
+	return u.String()
+}
+
+// Connect to Neo4j through a connection pool of its own, retrying for up
+// to `ConnectTimeout` or until `ctx` is done. Other HTTP clients of the
+// process keep the default transport.
+func (c *DBConfig) Open(ctx context.Context) (*DB, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = c.MaxIdleConns
+	transport.ResponseHeaderTimeout = c.Timeout
+	ctx, cancel := context.WithTimeout(ctx, c.ConnectTimeout)
+	defer cancel()
+	return ConnectDB(ctx, c.ConnectURI(), transport)
+}
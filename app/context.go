@@ -3,4 +3,6 @@ package app
 
 type AppContext struct {
 	DB *DB
+	// nil when requests aren't limited
+	Limiter *RateLimiter
 }
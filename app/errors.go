@@ -0,0 +1,205 @@
+// application errors
+// Handlers return an *Error, or any error along with its status, and
+// makeHandler answers with the JSON error envelope
+// {"code": "not_found", "message": "post not found", "details": ..., "requestId": "..."}
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jmcvetta/neoism"
+)
+
+type Error struct {
+	Status  int         `json:"-"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+	// the underlying error, logged but not sent
+	Err error `json:"-"`
+}
+
+// The problem with one field of a request body
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Codes of the error statuses
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusNotImplemented:        "not_implemented",
+	http.StatusBadGateway:            "upstream",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "timeout",
+}
+
+func newError(status int, message string, err error) *Error {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1))
+	}
+	return &Error{Status: status, Code: code, Message: message, Err: err}
+}
+
+// `what`, Ex. "post", matched nothing
+func NotFound(what string) *Error {
+	return newError(http.StatusNotFound, what+" not found", nil)
+}
+
+// The request can't be served as sent, Ex. a query parameter is out of range
+func BadRequest(message string) *Error {
+	return newError(http.StatusBadRequest, message, nil)
+}
+
+func Conflict(message string) *Error {
+	return newError(http.StatusConflict, message, nil)
+}
+
+// The `If-Match` precondition failed
+func PreconditionFailed(message string) *Error {
+	return newError(http.StatusPreconditionFailed, message, nil)
+}
+
+// The request body is invalid, `fields` tell where
+func Validation(message string, fields ...FieldError) *Error {
+	e := newError(http.StatusBadRequest, message, nil)
+	e.Code = "validation_failed"
+	if len(fields) > 0 {
+		e.Details = fields
+	}
+	return e
+}
+
+func Unauthorized(message string) *Error {
+	return newError(http.StatusUnauthorized, message, nil)
+}
+
+func Forbidden(message string) *Error {
+	return newError(http.StatusForbidden, message, nil)
+}
+
+// Neo4j didn't answer in time
+func Timeout(err error) *Error {
+	return newError(http.StatusGatewayTimeout, "database timed out", err)
+}
+
+// Neo4j failed or couldn't be reached
+func Upstream(err error) *Error {
+	return newError(http.StatusBadGateway, "database unavailable", err)
+}
+
+// Turn what a handler returned into an *Error. Errors from Neo4j are
+// mapped to their own status, other errors take `status`. The messages of
+// internal errors are not sent to the client.
+func AsError(status int, err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	if e = neo4jError(err); e != nil {
+		return e
+	}
+	if status < http.StatusBadRequest {
+		status = http.StatusInternalServerError
+	}
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		message = http.StatusText(status)
+	}
+	return newError(status, message, err)
+}
+
+// Map an error of neoism to its status, nil if it isn't one
+func neo4jError(err error) *Error {
+	var code, message string
+	var neoErr neoism.NeoError
+	var txErr *neoism.TxQueryError
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &neoErr):
+		code, message = neoErr.Exception, neoErr.Message
+	case errors.As(err, &txErr) && len(txErr.Errors) > 0:
+		code, message = txErr.Errors[0].Code, txErr.Errors[0].Message
+	case errors.Is(err, neoism.NotFound):
+		return newError(http.StatusNotFound, "not found", err)
+	case errors.As(err, &urlErr):
+		if urlErr.Timeout() {
+			return Timeout(err)
+		}
+		return Upstream(err)
+	default:
+		return nil
+	}
+
+	// legacy exception names, Ex. ConstraintViolationException, and status
+	// codes, Ex. Neo.ClientError.Schema.ConstraintValidationFailed
+	has := func(parts ...string) bool {
+		for _, p := range parts {
+			if strings.Contains(code, p) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("Constraint"):
+		return newError(http.StatusConflict, "conflicts with an existing node", err)
+	case has("EntityNotFound", "NodeNotFound", "RelationshipNotFound"):
+		return newError(http.StatusNotFound, "not found", err)
+	case has("Syntax", "ParameterMissing", "ParameterNotFound", "TypeError", "CypherTypeException", "ArgumentError"):
+		return newError(http.StatusBadRequest, "invalid query: "+message, err)
+	case has("TransientError", "Deadlock"):
+		return newError(http.StatusServiceUnavailable, "database busy, retry", err)
+	case has("Security"):
+		// our credentials, not the client's
+		return Upstream(err)
+	}
+	return newError(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), err)
+}
+
+// Write the error envelope of what a handler returned, logging server
+// errors
+func WriteError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	e := AsError(status, err)
+	if e.Status >= http.StatusInternalServerError {
+		Logger(r.Context()).Error("request failed", "status", e.Status, "err", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(struct {
+		*Error
+		RequestID string `json:"requestId,omitempty"`
+	}{e, RequestID(r.Context())})
+}
+
+// Answer 204 No Content, for requests with nothing to return
+func noContent(w http.ResponseWriter) (int, error) {
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,111 @@
+// home feed handlers
+package app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A page of the feed. Pass `NextCursor` back as `cursor` to get the next
+// page, it's empty on the last one.
+type FeedPage struct {
+	Posts      interface{} `json:"posts"`
+	NextCursor string      `json:"nextCursor"`
+}
+
+// Encode the position after a post as an opaque cursor
+func encodeFeedCursor(publishTime int, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(publishTime) + ":" + id))
+}
+
+// Decode a cursor made by encodeFeedCursor
+func decodeFeedCursor(cursor string) (publishTime int, id string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", errors.New("invalid cursor")
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return 0, "", errors.New("invalid cursor")
+	}
+	publishTime, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", errors.New("invalid cursor")
+	}
+	return publishTime, parts[1], nil
+}
+
+// handler for GET /feed
+// Published posts by the users the caller follows, newest first. With
+// `votes=true` posts those users voted for are blended in. Posts by users
+// the caller blocked or muted, or who blocked the caller, are left out.
+// Paginated with `cursor` and `limit`.
+func FeedGet(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	caller := callerId(r)
+	if caller == "" {
+		return http.StatusUnauthorized, Unauthorized("X-User-Id header required")
+	}
+	_, limit, err := pageParams(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	params := Props{
+		"caller":     caller,
+		"limit":      limit,
+		"withVotes":  r.URL.Query().Get("votes") == "true",
+		"cursorTime": nil,
+		"cursorId":   nil,
+	}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		cursorTime, cursorId, err := decodeFeedCursor(cursor)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		params["cursorTime"] = cursorTime
+		params["cursorId"] = cursorId
+	}
+
+	feedGet := `
+		MATCH (me:USER {id:{caller}})-[:FOLLOWS]->(:USER)-[act:CREATED|VOTED]->(p:POST)
+		WHERE (type(act) = 'CREATED' OR {withVotes})
+		AND coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false)
+		AND NOT (me)-[:CREATED]->(p)
+		WITH DISTINCT me, p
+		MATCH (author:USER)-[r:CREATED]->(p)
+		WHERE NOT (author)-[:BLOCKS]->(me) AND NOT (me)-[:BLOCKS|MUTES]->(author)
+		WITH author, r, p, coalesce(p.publishDate, r.createTime) as publishTime
+		WHERE {cursorTime} IS NULL OR publishTime < {cursorTime}
+		OR (publishTime = {cursorTime} AND p.id < {cursorId})
+		RETURN ` + POST_COLUMNS + `, publishTime as publishDate
+		ORDER BY publishTime DESC, p.id DESC
+		LIMIT {limit}
+	`
+	queryReqFeedGet := QueryRequest{
+		Name:   "get-feed",
+		Result: &[]Post{},
+		Query:  MakeQuery(feedGet, params, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqFeedGet, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	page := FeedPage{}
+	if posts := *result.Result.(*[]Post); len(posts) == limit {
+		last := posts[len(posts)-1]
+		page.NextCursor = encodeFeedCursor(last.PublishDate, last.Id)
+	}
+	page.Posts, err = getAuthorData(result.Result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,155 @@
+// follow handlers
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A user as listed among followers or followings
+type UserSummary struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Since int    `json:"since,omitempty"`
+}
+
+type FollowRel struct {
+	Since int  `json:"since"`
+	Found bool `json:"found"`
+}
+
+// handler for PUT /users/:id/follow
+// Body: {"id": followerId}. Following someone twice keeps the first
+// `since`, `found` tells whether the follow already existed.
+func UserFollow(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	var props UserIdRequest
+	err := decodeBody(w, r, &props)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if props.Id == ps.ByName("id") {
+		return http.StatusBadRequest, BadRequest("users cannot follow themselves")
+	}
+	blocked, err := eitherBlocks(context, props.Id, ps.ByName("id"))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if blocked {
+		return http.StatusForbidden, Forbidden("users blocking each other cannot follow")
+	}
+
+	userFollow := `
+		MATCH (u:USER {id: {uid}}), (other:USER {id: {id}})
+		MERGE (u)-[f:FOLLOWS]->(other)
+		ON CREATE SET f.since=timestamp(), f.found=false
+		ON MATCH SET f.found=true
+		RETURN f.since as since, f.found as found
+	`
+	queryReqUserFollow := QueryRequest{
+		Name:   "follow-user",
+		Result: &[]FollowRel{},
+		Query: MakeQuery(
+			userFollow,
+			Props{"uid": props.Id, "id": ps.ByName("id")},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqUserFollow, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	follows := *result.Result.(*[]FollowRel)
+	if len(follows) == 0 {
+		return http.StatusNotFound, NotFound("user")
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(follows[0])
+}
+
+// handler for DELETE /users/:id/follow
+// Body: {"id": followerId}
+func UserUnfollow(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	var props UserIdRequest
+	err := decodeBody(w, r, &props)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	userUnfollow := `
+		MATCH (u:USER {id: {uid}})-[f:FOLLOWS]->(other:USER {id: {id}})
+		DELETE f
+	`
+	queryReqUserUnfollow := QueryRequest{
+		Name:   "unfollow-user",
+		Result: nil,
+		Query: MakeQuery(
+			userUnfollow,
+			Props{"uid": props.Id, "id": ps.ByName("id")},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqUserUnfollow, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return noContent(w)
+}
+
+// handler for GET /users/:id/followers
+// Most recent followers first, paginated with `skip` and `limit`
+func UserGetFollowers(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	userGetFollowers := `
+		MATCH (follower:USER)-[f:FOLLOWS]->(u:USER {id: {id}})
+		RETURN follower.id as id, follower.name as name, f.since as since
+		ORDER BY f.since DESC
+		SKIP {skip}
+		LIMIT {limit}
+	`
+	return userGetFollows(context, w, r, ps, "get-user-followers", userGetFollowers)
+}
+
+// handler for GET /users/:id/following
+// Most recently followed first, paginated with `skip` and `limit`
+func UserGetFollowing(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	userGetFollowing := `
+		MATCH (u:USER {id: {id}})-[f:FOLLOWS]->(followed:USER)
+		RETURN followed.id as id, followed.name as name, f.since as since
+		ORDER BY f.since DESC
+		SKIP {skip}
+		LIMIT {limit}
+	`
+	return userGetFollows(context, w, r, ps, "get-user-following", userGetFollowing)
+}
+
+// Run a paginated query listing `UserSummary`s of user `:id`
+func userGetFollows(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params, name string, statement string) (int, error) {
+	skip, limit, err := pageParams(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	queryReqGetFollows := QueryRequest{
+		Name:   name,
+		Result: &[]UserSummary{},
+		Query: MakeQuery(
+			statement,
+			Props{"id": ps.ByName("id"), "skip": skip, "limit": limit},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqGetFollows, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
+}
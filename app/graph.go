@@ -0,0 +1,190 @@
+// subgraph export for visualization
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// default and maximum number of hops from the center node
+	defaultGraphDepth = 2
+	maxGraphDepth     = 3
+	// default and maximum number of nodes returned, the center included
+	defaultGraphNodes = 100
+	maxGraphNodes     = 500
+)
+
+type GraphNode struct {
+	Id         string                 `json:"id"`
+	Labels     []string               `json:"labels"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GraphEdge struct {
+	Id     string `json:"id"`
+	Type   string `json:"type"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// Plain nodes-and-edges document. `Truncated` is true when nodes were
+// left out because of the node limit.
+type Graph struct {
+	Nodes     []GraphNode `json:"nodes"`
+	Edges     []GraphEdge `json:"edges"`
+	Truncated bool        `json:"truncated"`
+}
+
+// Cytoscape.js elements JSON
+func (g *Graph) cytoscape() interface{} {
+	type element struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	nodes := make([]element, len(g.Nodes))
+	for i, n := range g.Nodes {
+		data := map[string]interface{}{"id": n.Id, "label": firstLabel(n.Labels)}
+		for k, v := range n.Properties {
+			data[k] = v
+		}
+		nodes[i] = element{data}
+	}
+	edges := make([]element, len(g.Edges))
+	for i, e := range g.Edges {
+		edges[i] = element{map[string]interface{}{
+			"id": e.Id, "source": e.Source, "target": e.Target, "label": e.Type,
+		}}
+	}
+	return map[string]interface{}{
+		"elements":  map[string]interface{}{"nodes": nodes, "edges": edges},
+		"truncated": g.Truncated,
+	}
+}
+
+// d3-force nodes and links
+func (g *Graph) d3() interface{} {
+	nodes := make([]map[string]interface{}, len(g.Nodes))
+	for i, n := range g.Nodes {
+		node := map[string]interface{}{"id": n.Id, "group": firstLabel(n.Labels)}
+		for k, v := range n.Properties {
+			node[k] = v
+		}
+		nodes[i] = node
+	}
+	links := make([]map[string]interface{}, len(g.Edges))
+	for i, e := range g.Edges {
+		links[i] = map[string]interface{}{"source": e.Source, "target": e.Target, "type": e.Type}
+	}
+	return map[string]interface{}{"nodes": nodes, "links": links, "truncated": g.Truncated}
+}
+
+func firstLabel(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return labels[0]
+}
+
+// Read an integer query parameter between 1 and max, def if absent
+func intParam(r *http.Request, name string, def int, max int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 1 || v > max {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, max)
+	}
+	return v, nil
+}
+
+// handler for GET /graph/:id
+// Nodes within `depth` hops of node `:id` and the relationships between
+// them, following only `types` if given. `limit` caps the number of
+// nodes, `format` is json (default), cytoscape or d3.
+func GraphGet(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	depth, err := intParam(r, "depth", defaultGraphDepth, maxGraphDepth)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	limit, err := intParam(r, "limit", defaultGraphNodes, maxGraphNodes)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	types, err := relationTypePattern(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "cytoscape" && format != "d3" {
+		return http.StatusBadRequest, BadRequest("format must be json, cytoscape or d3")
+	}
+
+	// unpublished and hidden posts are left out, as the center and along
+	// the way, and only display properties are exported, never emails or
+	// password hashes. The expansion stops once `limit` nodes are found.
+	graphGet := `
+		MATCH (center {id:{id}})
+		WHERE NOT center:POST OR coalesce(center.status, 'published') = 'published' AND NOT coalesce(center.hidden, false)
+		OPTIONAL MATCH path = (center)-[` + types + `*1..` + strconv.Itoa(depth) + `]-(n)
+		WHERE n <> center AND ALL(x IN nodes(path) WHERE
+			NOT x:POST OR coalesce(x.status, 'published') = 'published' AND NOT coalesce(x.hidden, false))
+		WITH DISTINCT center, n
+		LIMIT {limit}
+		WITH center, collect(n) as found
+		WITH [center] + found[0..{limit} - 1] as nodes, size(found) + 1 as total
+		UNWIND nodes as a
+		OPTIONAL MATCH (a)-[rel` + types + `]->(b)
+		WHERE b IN nodes
+		WITH nodes, total, collect(DISTINCT rel) as rels
+		RETURN extract(n IN nodes | {
+			id: coalesce(n.id, n.slug, toString(id(n))),
+			labels: labels(n),
+			properties: {name: n.name, title: n.title, type: n.type,
+				status: n.status, slug: n.slug, number: n.number}
+		}) as nodes,
+		extract(rel IN rels | {
+			id: toString(id(rel)),
+			type: type(rel),
+			source: coalesce(startNode(rel).id, startNode(rel).slug, toString(id(startNode(rel)))),
+			target: coalesce(endNode(rel).id, endNode(rel).slug, toString(id(endNode(rel))))
+		}) as edges,
+		total > {limit} as truncated
+	`
+	queryReqGraphGet := QueryRequest{
+		Name:   "graph-get",
+		Result: &[]Graph{},
+		Query:  MakeQuery(graphGet, Props{"id": ps.ByName("id"), "limit": limit}, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqGraphGet, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	graphs := *result.Result.(*[]Graph)
+	if len(graphs) == 0 {
+		return http.StatusNotFound, NotFound("node")
+	}
+	graph := &graphs[0]
+	// drop the properties a node doesn't have
+	for _, n := range graph.Nodes {
+		for k, v := range n.Properties {
+			if v == nil {
+				delete(n.Properties, k)
+			}
+		}
+	}
+
+	switch format {
+	case "cytoscape":
+		return http.StatusOK, json.NewEncoder(w).Encode(graph.cytoscape())
+	case "d3":
+		return http.StatusOK, json.NewEncoder(w).Encode(graph.d3())
+	}
+	return http.StatusOK, json.NewEncoder(w).Encode(graph)
+}
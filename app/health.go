@@ -0,0 +1,128 @@
+// health, readiness and version handlers
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Build metadata, set with
+// -ldflags "-X github.com/leozhucong/wok-go-neo4j/app.BuildVersion=1.2.0 ..."
+var (
+	BuildVersion = "dev"
+	BuildCommit  = ""
+	BuildTime    = ""
+)
+
+// How long /readyz waits for Neo4j
+var ReadyTimeout = 2 * time.Second
+
+var startTime = time.Now()
+
+type Neo4jStatus struct {
+	Reachable bool    `json:"reachable"`
+	Version   string  `json:"version,omitempty"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Readiness struct {
+	Status string      `json:"status"`
+	Neo4j  Neo4jStatus `json:"neo4j"`
+}
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"buildTime,omitempty"`
+	Go        string `json:"go"`
+	Uptime    string `json:"uptime"`
+}
+
+// handler for GET /healthz
+// The process is up and serving
+func HealthGet(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	return http.StatusOK, json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handler for GET /readyz
+// Runs a trivial query against Neo4j, answers 503 with status "degraded"
+// when it fails or takes longer than ReadyTimeout
+func ReadyGet(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	readiness := Readiness{
+		Status: "ok",
+		Neo4j:  Neo4jStatus{Version: context.DB.Version},
+	}
+
+	start := time.Now()
+	err := pingDB(context.DB, ReadyTimeout)
+	readiness.Neo4j.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		readiness.Status = "degraded"
+		readiness.Neo4j.Error = err.Error()
+	} else {
+		readiness.Neo4j.Reachable = true
+	}
+
+	status := http.StatusOK
+	if !readiness.Neo4j.Reachable {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return status, json.NewEncoder(w).Encode(readiness)
+}
+
+// handler for GET /version
+func VersionGet(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	info := VersionInfo{
+		Version:   BuildVersion,
+		Commit:    BuildCommit,
+		BuildTime: BuildTime,
+		Go:        runtime.Version(),
+		Uptime:    time.Since(startTime).Round(time.Second).String(),
+	}
+	// fall back to what the go tool recorded
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildTime == "":
+				info.BuildTime = s.Value
+			}
+		}
+	}
+	return http.StatusOK, json.NewEncoder(w).Encode(info)
+}
+
+// Run `RETURN 1`, giving up after `timeout`. neoism can't cancel a request,
+// so a late answer is left to the goroutine.
+func pingDB(db *DB, timeout time.Duration) error {
+	ping := QueryRequest{
+		Name: "ping",
+		Result: &[]struct {
+			Ok int `json:"ok"`
+		}{},
+		Query: MakeQuery("RETURN 1 as ok", nil, nil),
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		result := QueryResult{}
+		errc <- db.RunSingleQuery(ping, &result)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(timeout):
+		return errors.New("timed out after " + timeout.String())
+	}
+}
@@ -0,0 +1,116 @@
+// structured logging and request ids
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Header carrying the request id, taken from the client when given
+const RequestIDHeader = "X-Request-ID"
+
+// Fields whose values never reach the logs
+var RedactedFields = []string{"password", "hashedPassword", "salt", "email"}
+
+const redacted = "[REDACTED]"
+
+type requestIDKey struct{}
+
+// Make the JSON logger at `level` the default, for `slog` and `log` alike.
+// Values of redacted `fields`, at any depth, are replaced.
+func SetupLogging(level string, fields []string) {
+	RedactedFields = fields
+	var l slog.Level
+	l.UnmarshalText([]byte(level))
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		Level: l,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if isRedacted(a.Key) {
+				return slog.String(a.Key, redacted)
+			}
+			if a.Value.Kind() == slog.KindAny {
+				a.Value = slog.AnyValue(redact(a.Value.Any()))
+			}
+			return a
+		},
+	})
+	slog.SetDefault(slog.New(handler))
+}
+
+func isRedacted(field string) bool {
+	for _, f := range RedactedFields {
+		if strings.EqualFold(f, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// A copy of `v` with the values of redacted fields replaced, for logging
+// request bodies and query parameters
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if isRedacted(k) {
+				c[k] = redacted
+			} else {
+				c[k] = redact(e)
+			}
+		}
+		return c
+	case Props:
+		return redact(map[string]interface{}(v))
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = redact(e)
+		}
+		return c
+	}
+	return v
+}
+
+// Attach request id `id` to `ctx`
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// The request id attached to `ctx`, empty if none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// The default logger, with the request id and trace id of `ctx` if it
+// has them
+func Logger(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if id := RequestID(ctx); id != "" {
+		logger = logger.With("requestId", id)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		logger = logger.With("traceId", sc.TraceID().String())
+	}
+	return logger
+}
+
+// The request id to use for `r`: the client's if it is sane, else a new one
+func NewRequestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > 128 {
+		return newId()
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return newId()
+		}
+	}
+	return id
+}
@@ -0,0 +1,175 @@
+// Prometheus metrics in the text exposition format
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Upper bounds in seconds of the latency histogram buckets
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = newMetric("http_requests_total", "counter",
+		"HTTP requests by route pattern and status.", []string{"method", "route", "status"})
+	httpRequestDuration = newMetric("http_request_duration_seconds", "histogram",
+		"HTTP request latency by route pattern and status.", []string{"method", "route", "status"})
+	cypherQueries = newMetric("cypher_queries_total", "counter",
+		"Cypher queries run, by query name.", []string{"query"})
+	cypherQueryErrors = newMetric("cypher_query_errors_total", "counter",
+		"Cypher queries that failed, by query name.", []string{"query"})
+	cypherQueryDuration = newMetric("cypher_query_duration_seconds", "histogram",
+		"Cypher query latency by query name.", []string{"query"})
+	rateLimited = newMetric("rate_limited_requests_total", "counter",
+		"Requests refused by a rate limit, by policy.", []string{"policy"})
+
+	metrics = []*metric{httpRequests, httpRequestDuration, cypherQueries, cypherQueryErrors, cypherQueryDuration, rateLimited}
+)
+
+// A counter or histogram with labels
+type metric struct {
+	name   string
+	kind   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// The values of a metric for one set of label values. A counter only
+// uses `count`.
+type series struct {
+	labels  []string
+	count   float64
+	sum     float64
+	buckets []uint64
+}
+
+func newMetric(name string, kind string, help string, labels []string) *metric {
+	return &metric{
+		name:   name,
+		kind:   kind,
+		help:   help,
+		labels: labels,
+		series: map[string]*series{},
+	}
+}
+
+// The series of `labels`, created if missing. Must hold m.mu.
+func (m *metric) get(labels []string) *series {
+	key := strings.Join(labels, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		if m.kind == "histogram" {
+			s.buckets = make([]uint64, len(latencyBuckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) inc(labels ...string) {
+	m.mu.Lock()
+	m.get(labels).count++
+	m.mu.Unlock()
+}
+
+func (m *metric) observe(d time.Duration, labels ...string) {
+	v := d.Seconds()
+	m.mu.Lock()
+	s := m.get(labels)
+	s.count++
+	s.sum += v
+	for i, le := range latencyBuckets {
+		if v <= le {
+			s.buckets[i]++
+		}
+	}
+	m.mu.Unlock()
+}
+
+// Write the metric in the text exposition format, series sorted by labels
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		labels := m.labelPairs(s.labels)
+		if m.kind == "counter" {
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, labels, formatFloat(s.count))
+			continue
+		}
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", m.name, labels, formatFloat(le), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %s\n", m.name, labels, formatFloat(s.count))
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", m.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %s\n", m.name, labels, formatFloat(s.count))
+	}
+}
+
+// Ex. method="GET",route="/posts/:id"
+func (m *metric) labelPairs(values []string) string {
+	pairs := make([]string, len(values))
+	for i, v := range values {
+		pairs[i] = m.labels[i] + `="` + labelEscaper.Replace(v) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Record a served request. `route` is the route pattern, Ex. /posts/:id,
+// not the path, to keep the number of series bounded.
+func ObserveRequest(method string, route string, status int, d time.Duration) {
+	code := strconv.Itoa(status)
+	httpRequests.inc(method, route, code)
+	httpRequestDuration.observe(d, method, route, code)
+}
+
+// Record a Cypher query run under `name`
+func observeQuery(name string, d time.Duration, err error) {
+	cypherQueries.inc(name)
+	cypherQueryDuration.observe(d, name)
+	if err != nil {
+		cypherQueryErrors.inc(name)
+	}
+}
+
+// handler for GET /metrics
+func MetricsGet(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	fmt.Fprintf(buf, "# HELP go_goroutines Number of goroutines.\n# TYPE go_goroutines gauge\ngo_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(buf, "# HELP process_start_time_seconds Start time of the process in seconds since the epoch.\n# TYPE process_start_time_seconds gauge\nprocess_start_time_seconds %d\n", startTime.Unix())
+	return http.StatusOK, buf.Flush()
+}
@@ -0,0 +1,371 @@
+// reporting and moderation handlers
+// Reports are stored as (USER)-[:FILED]->(REPORT)-[:AGAINST]->(POST|USER)
+// and go open -> actioned or dismissed. Moderators resolve them with
+// (USER)-[:RESOLVED]->(REPORT), and every moderator action is kept as
+// (USER)-[:MODERATED {action}]->(POST|USER).
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Values of `Report.Status`
+const (
+	ReportStatusOpen      = "open"
+	ReportStatusActioned  = "actioned"
+	ReportStatusDismissed = "dismissed"
+)
+
+var (
+	// Reason codes a report can be filed with
+	ReportReasons = []string{"spam", "harassment", "hate", "violence", "nudity", "misinformation", "other"}
+	// Roles of users allowed to moderate
+	ModeratorRoles = []string{"admin", "moderator"}
+	// A post is hidden once this many reports against it are open, 0
+	// turns automatic hiding off
+	ReportHideThreshold = 5
+)
+
+// A moderation action: the label of the node it applies to and the
+// property it sets
+type moderationAction struct {
+	Label    string
+	Property string
+	Value    bool
+}
+
+var moderationActions = map[string]moderationAction{
+	"hide_post":      {"POST", "hidden", true},
+	"unhide_post":    {"POST", "hidden", false},
+	"suspend_user":   {"USER", "suspended", true},
+	"unsuspend_user": {"USER", "suspended", false},
+}
+
+type Report struct {
+	Id          string `json:"id"`
+	Reason      string `json:"reason"`
+	Note        string `json:"note"`
+	Status      string `json:"status"`
+	Reporter    string `json:"reporter"`
+	Target      string `json:"target"`
+	TargetType  string `json:"targetType"`
+	PostAuthor  string `json:"postAuthor,omitempty"`
+	OpenReports int    `json:"openReports"`
+	CreateTime  int    `json:"createTime"`
+	ResolvedBy  string `json:"resolvedBy,omitempty"`
+	ResolvedAt  int    `json:"resolvedAt,omitempty"`
+	Action      string `json:"action,omitempty"`
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the caller (`X-User-Id`) is a moderator, return their id
+func requireModerator(context *AppContext, r *http.Request) (string, int, error) {
+	caller := callerId(r)
+	if caller == "" {
+		return "", http.StatusUnauthorized, Unauthorized("X-User-Id header required")
+	}
+	findModerator := `
+		MATCH (u:USER {id: {id}})
+		WHERE u.role IN {roles} AND NOT coalesce(u.suspended, false)
+		RETURN u.id as id
+	`
+	ok, err := anyRow(context, "find-moderator", findModerator, Props{"id": caller, "roles": ModeratorRoles})
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	if !ok {
+		return "", http.StatusForbidden, Forbidden("moderator role required")
+	}
+	return caller, http.StatusOK, nil
+}
+
+// Whether user `id` is suspended
+func userSuspended(context *AppContext, id string) (bool, error) {
+	findSuspended := `
+		MATCH (u:USER {id: {id}})
+		WHERE coalesce(u.suspended, false)
+		RETURN u.id as id
+	`
+	return anyRow(context, "find-suspended-user", findSuspended, Props{"id": id})
+}
+
+// handler for POST /posts/:id/report
+// Body: {"id": reporterId, "reason": code, "note": text}
+func PostReport(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	return reportCreate(context, w, r, ps, "POST")
+}
+
+// handler for POST /users/:id/report
+// Body: {"id": reporterId, "reason": code, "note": text}
+func UserReport(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	return reportCreate(context, w, r, ps, "USER")
+}
+
+// File a report against node `:id` labelled `label`. A user can only have
+// one open report against the same node.
+func reportCreate(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params, label string) (int, error) {
+	var props ReportRequest
+	err := decodeBody(w, r, &props)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if !contains(ReportReasons, props.Reason) {
+		return http.StatusBadRequest, BadRequest(fmt.Sprintf("reason must be one of %v", ReportReasons))
+	}
+	if label == "USER" && props.Id == ps.ByName("id") {
+		return http.StatusBadRequest, BadRequest("users cannot report themselves")
+	}
+	suspended, err := userSuspended(context, props.Id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if suspended {
+		return http.StatusForbidden, Forbidden("suspended users cannot report")
+	}
+
+	findOpenReport := `
+		MATCH (:USER {id: {uid}})-[:FILED]->(rep:REPORT {status: 'open'})-[:AGAINST]->(target:` + label + ` {id: {id}})
+		RETURN rep.id as id
+	`
+	params := Props{"uid": props.Id, "id": ps.ByName("id")}
+	reported, err := anyRow(context, "find-open-report", findOpenReport, params)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if reported {
+		return http.StatusConflict, Conflict("already reported")
+	}
+
+	// only posts are hidden automatically, reported users wait for a
+	// moderator
+	reportCreate := `
+		MATCH (reporter:USER {id: {uid}}), (target:` + label + ` {id: {id}})
+		CREATE (reporter)-[:FILED]->(rep:REPORT {id: {rid}, reason: {reason}, note: {note},
+			status: 'open', createTime: timestamp()})-[:AGAINST]->(target)
+		WITH reporter, rep, target, size((target)<-[:AGAINST]-(:REPORT {status: 'open'})) as openReports
+		FOREACH (_ IN CASE WHEN target:POST AND {threshold} > 0 AND openReports >= {threshold}
+			AND NOT coalesce(target.hidden, false) THEN [1] ELSE [] END |
+			SET target.hidden = true, target.hiddenAt = timestamp())
+		RETURN rep.id as id, rep.reason as reason, rep.note as note, rep.status as status,
+		reporter.id as reporter, target.id as target, labels(target)[0] as targetType,
+		openReports, rep.createTime as createTime
+	`
+	params["rid"] = newId()
+	params["reason"] = props.Reason
+	params["note"] = props.Note
+	params["threshold"] = ReportHideThreshold
+	queryReqReportCreate := QueryRequest{
+		Name:   "create-report",
+		Result: &[]Report{},
+		Query:  MakeQuery(reportCreate, params, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqReportCreate, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	reports := *result.Result.(*[]Report)
+	if len(reports) == 0 {
+		return http.StatusNotFound, NotFound("reporter or " + label)
+	}
+
+	return http.StatusCreated, json.NewEncoder(w).Encode(reports[0])
+}
+
+// handler for GET /moderation/reports
+// Reports in `status` (open by default), the most reported targets first.
+// Paginated with `skip` and `limit`, moderators only.
+func ModerationGetReports(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	if _, status, err := requireModerator(context, r); err != nil {
+		return status, err
+	}
+	skip, limit, err := pageParams(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = ReportStatusOpen
+	}
+	if !contains([]string{ReportStatusOpen, ReportStatusActioned, ReportStatusDismissed}, status) {
+		return http.StatusBadRequest, BadRequest("status must be open, actioned or dismissed")
+	}
+
+	moderationGetReports := `
+		MATCH (reporter:USER)-[:FILED]->(rep:REPORT {status: {status}})-[:AGAINST]->(target)
+		OPTIONAL MATCH (moderator:USER)-[res:RESOLVED]->(rep)
+		OPTIONAL MATCH (postAuthor:USER)-[:CREATED]->(target)
+		RETURN rep.id as id, rep.reason as reason, rep.note as note, rep.status as status,
+		reporter.id as reporter, target.id as target, labels(target)[0] as targetType,
+		postAuthor.id as postAuthor,
+		size((target)<-[:AGAINST]-(:REPORT {status: 'open'})) as openReports,
+		rep.createTime as createTime, moderator.id as resolvedBy,
+		res.at as resolvedAt, res.action as action
+		ORDER BY openReports DESC, createTime
+		SKIP {skip}
+		LIMIT {limit}
+	`
+	queryReqGetReports := QueryRequest{
+		Name:   "moderation-get-reports",
+		Result: &[]Report{},
+		Query: MakeQuery(
+			moderationGetReports,
+			Props{"status": status, "skip": skip, "limit": limit},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqGetReports, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
+}
+
+// handler for PUT /moderation/reports/:rid
+// Body: {"status": "actioned"|"dismissed", "action": action, "note": text}.
+// Actioned reports take hide_post or suspend_user, the latter suspends
+// the author when the report is against a post. Moderators only.
+func ModerationResolveReport(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	moderator, status, err := requireModerator(context, r)
+	if err != nil {
+		return status, err
+	}
+	var props ResolveRequest
+	err = decodeBody(w, r, &props)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	switch {
+	case props.Status == ReportStatusDismissed && props.Action != "":
+		return http.StatusBadRequest, BadRequest("dismissed reports take no action")
+	case props.Status == ReportStatusActioned && props.Action == "":
+		return http.StatusBadRequest, BadRequest("action must be hide_post or suspend_user")
+	}
+
+	reportFindById := `
+		MATCH (reporter:USER)-[:FILED]->(rep:REPORT {id: {rid}})-[:AGAINST]->(target)
+		OPTIONAL MATCH (postAuthor:USER)-[:CREATED]->(target)
+		RETURN rep.id as id, rep.status as status, target.id as target,
+		labels(target)[0] as targetType, postAuthor.id as postAuthor
+	`
+	queryReqFindReport := QueryRequest{
+		Name:   "find-report-by-id",
+		Result: &[]Report{},
+		Query:  MakeQuery(reportFindById, Props{"rid": ps.ByName("rid")}, nil),
+	}
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqFindReport, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	reports := *result.Result.(*[]Report)
+	if len(reports) == 0 {
+		return http.StatusNotFound, NotFound("report")
+	}
+	report := reports[0]
+	if report.Status != ReportStatusOpen {
+		return http.StatusConflict, Conflict(fmt.Sprintf("report is already %s", report.Status))
+	}
+	if props.Action == "hide_post" && report.TargetType != "POST" {
+		return http.StatusBadRequest, BadRequest("hide_post only applies to reports against posts")
+	}
+
+	reportResolve := `
+		MATCH (moderator:USER {id: {mid}}), (rep:REPORT {id: {rid}, status: 'open'})
+		SET rep.status = {status}
+		CREATE (moderator)-[:RESOLVED {at: timestamp(), action: {action}, note: {note}}]->(rep)
+		RETURN rep.id as id
+	`
+	queries := []QueryRequest{{
+		Name:   "resolve-report",
+		Result: &[]Report{},
+		Query: MakeQuery(reportResolve, Props{
+			"mid":    moderator,
+			"rid":    report.Id,
+			"status": props.Status,
+			"action": props.Action,
+			"note":   props.Note,
+		}, nil),
+	}}
+	if props.Action != "" {
+		target := report.Target
+		if props.Action == "suspend_user" && report.TargetType == "POST" {
+			target = report.PostAuthor
+		}
+		queries = append(queries, moderateQuery(moderator, props.Action, target, props.Note))
+	}
+
+	if _, err = context.DB.RunTransaction(queries); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return noContent(w)
+}
+
+// handler for POST /moderation/posts/:id/hide, /moderation/posts/:id/unhide,
+// /moderation/users/:id/suspend and /moderation/users/:id/unsuspend
+// Body: {"note": text}, optional. Moderators only.
+func ModerationAct(action string) func(*AppContext, http.ResponseWriter, *http.Request, httprouter.Params) (int, error) {
+	return func(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+		moderator, status, err := requireModerator(context, r)
+		if err != nil {
+			return status, err
+		}
+		var props NoteRequest
+		err = decodeOptionalBody(w, r, &props)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		results, err := context.DB.RunTransaction([]QueryRequest{
+			moderateQuery(moderator, action, ps.ByName("id"), props.Note),
+		})
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if len(*results[0].Result.(*[]Report)) == 0 {
+			return http.StatusNotFound, NotFound(moderationActions[action].Label)
+		}
+
+		return noContent(w)
+	}
+}
+
+// Build the query applying moderation `action` by `moderator` to node `id`
+// and recording it on the graph
+func moderateQuery(moderator string, action string, id string, note string) QueryRequest {
+	act := moderationActions[action]
+	moderate := `
+		MATCH (moderator:USER {id: {mid}}), (target:` + act.Label + ` {id: {id}})
+		SET target.` + act.Property + ` = {value}
+		CREATE (moderator)-[:MODERATED {action: {action}, at: timestamp(), note: {note}}]->(target)
+		RETURN target.id as target
+	`
+	return QueryRequest{
+		Name:   "moderate-" + action,
+		Result: &[]Report{},
+		Query: MakeQuery(moderate, Props{
+			"mid":    moderator,
+			"id":     id,
+			"value":  act.Value,
+			"action": action,
+			"note":   note,
+		}, nil),
+	}
+}
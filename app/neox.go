@@ -2,11 +2,25 @@
 package app
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
 	"github.com/jmcvetta/neoism"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Longest wait between two attempts of ConnectDB
+const maxConnectBackoff = 30 * time.Second
+
 type DB struct {
 	*neoism.Database
+	// transport of the requests to Neo4j, nil for the default one
+	transport *http.Transport
+	// context of the request the queries are run for
+	ctx context.Context
 }
 
 type Query struct {
@@ -33,20 +47,92 @@ type QueryResult struct {
 	Result  interface{}
 }
 
-// Wrapper for neoism's connect but return `Client` struct
-func OpenDB(uri string) (*DB, error) {
+// Wrapper for neoism's connect but return `Client` struct. Queries are
+// sent through `transport`, or the default transport when nil.
+func OpenDB(uri string, transport *http.Transport) (*DB, error) {
 	db, err := neoism.Connect(uri)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db}, nil
+	if transport != nil {
+		db.Session.Client = &http.Client{Transport: transport}
+	}
+	return &DB{Database: db, transport: transport}, nil
+}
+
+// A copy of `db` running its queries on behalf of the request of `ctx`,
+// their log lines carry its request id and their spans are children of
+// its span
+func (db *DB) WithContext(ctx context.Context) *DB {
+	return &DB{Database: db.Database, transport: db.transport, ctx: ctx}
+}
+
+func (db *DB) requestContext() context.Context {
+	if db.ctx == nil {
+		return context.Background()
+	}
+	return db.ctx
+}
+
+// Connect to `uri` like OpenDB, retrying with exponential backoff until it
+// succeeds or `ctx` is done
+func ConnectDB(ctx context.Context, uri string, transport *http.Transport) (*DB, error) {
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		db, err := OpenDB(uri, transport)
+		if err == nil {
+			return db, nil
+		}
+		slog.Warn("connect database failed", "attempt", attempt, "retryIn", backoff.String(), "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("connect database: %v", err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// Close the idle connections to Neo4j
+func (db *DB) Close() error {
+	if db.transport != nil {
+		db.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// Run `query` named `name`, recording its metrics and span
+func (db *DB) cypher(name string, query *neoism.CypherQuery) error {
+	span := startQuerySpan(db.requestContext(), name)
+	start := time.Now()
+	err := db.Cypher(query)
+	db.logQuery(name, query, time.Since(start), err)
+	endQuerySpan(span, query.Result, err)
+	return err
+}
+
+// Record a query in the metrics and the log. The statement is left out
+// of the log as it may hold user data, the parameters are redacted.
+func (db *DB) logQuery(name string, query *neoism.CypherQuery, d time.Duration, err error) {
+	observeQuery(name, d, err)
+	logger := Logger(db.requestContext())
+	ms := float64(d.Microseconds()) / 1000
+	if err != nil {
+		logger.Error("cypher query failed", "query", name, "durationMs", ms, "err", err)
+		return
+	}
+	logger.Debug("cypher query", "query", name, "durationMs", ms,
+		"params", redact(map[string]interface{}(query.Parameters)))
 }
 
 // Run a single query and save the result in result
 func (db *DB) RunSingleQuery(query QueryRequest, result *QueryResult) error {
 	result.Result = query.Result
 	query.Query.Result = result.Result
-	err := db.Cypher(query.Query.CypherQuery)
+	err := db.cypher(query.Name, query.Query.CypherQuery)
 	if err != nil {
 		return err
 	}
@@ -56,38 +142,87 @@ func (db *DB) RunSingleQuery(query QueryRequest, result *QueryResult) error {
 }
 
 // Run the queries concurrently and accept a handler function to do some
-// post-processing of the result retrieved from database
+// post-processing of the result retrieved from database. The first query
+// failing fails them all, once every query is done.
 func (db *DB) RunConcurrentQueries(queries []QueryRequest, handler func([]QueryResult) (interface{}, error)) (interface{}, error) {
-	queryLen := len(queries)
-	// TODO use lock for maps to garantee sync concurrency
-	results := make([]QueryResult, queryLen)
-	ch := make(chan QueryResult, queryLen)
+	type queryDone struct {
+		result QueryResult
+		err    error
+	}
+	results := make([]QueryResult, len(queries))
+	ch := make(chan queryDone, len(queries))
 	for _, query := range queries {
 		// Note: we pass an copy of query to runSingleQuery,
 		// not the address of it, otherwise the following goroutines will
 		// get uncertain query since they all have the same address.
 		// Therefore all the result information should be retrieved
-		// from QueryResult rather than QueryRequest
+		// from QueryResult rather than QueryRequest.
+		// The spans of the queries all hang from the request's span, db
+		// carries its context into the goroutines.
 		go func() {
 			result := QueryResult{}
 			result.Result = query.Result
 			query.Query.Result = result.Result
-			err := db.Cypher(query.Query.CypherQuery)
+			err := db.cypher(query.Name, query.Query.CypherQuery)
 			if err != nil {
-				panic("Err in runSingleQuery: " + err.Error())
+				ch <- queryDone{err: fmt.Errorf("query %s: %w", query.Name, err)}
+				return
 			}
 			result.Name = query.Name
 			result.Columns = query.Query.Columns()
-			ch <- result
+			ch <- queryDone{result: result}
 		}()
 	}
-	for j, _ := range results {
-		r := <-ch
-		results[j] = r
+	var err error
+	for j := range results {
+		done := <-ch
+		if done.err != nil && err == nil {
+			err = done.err
+		}
+		results[j] = done.result
+	}
+	if err != nil {
+		return nil, err
 	}
 	return handler(results)
 }
 
+// Run the queries in order within a single transaction, either all of them
+// are committed or none. Results are returned in the order of the queries.
+func (db *DB) RunTransaction(queries []QueryRequest) ([]QueryResult, error) {
+	qs := make([]*neoism.CypherQuery, len(queries))
+	results := make([]QueryResult, len(queries))
+	for i, query := range queries {
+		results[i].Name = query.Name
+		results[i].Result = query.Result
+		query.Query.Result = query.Result
+		qs[i] = query.Query.CypherQuery
+	}
+	spans := make([]trace.Span, len(queries))
+	for i, query := range queries {
+		spans[i] = startQuerySpan(db.requestContext(), query.Name)
+	}
+	start := time.Now()
+	tx, err := db.Begin(qs)
+	if err == nil {
+		err = tx.Commit()
+	} else if tx != nil {
+		tx.Rollback()
+	}
+	// every query of the transaction takes the time of the whole
+	for i, query := range queries {
+		db.logQuery(query.Name, query.Query.CypherQuery, time.Since(start), err)
+		endQuerySpan(spans[i], query.Result, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, query := range queries {
+		results[i].Columns = query.Query.Columns()
+	}
+	return results, nil
+}
+
 // make a cypher query
 func MakeQuery(statement string, params map[string]interface{}, result *interface{}) *Query {
 	return &Query{
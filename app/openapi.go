@@ -0,0 +1,440 @@
+// OpenAPI 3 document of the API
+// The document is built at startup from the routes registered on the
+// router and routeDocs below, which says what each of them takes and
+// returns. Schemas are read off the Go types by reflection, with the rules
+// of `validate` tags.
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// What a route takes and returns
+type RouteDoc struct {
+	Summary string
+	// query parameters, keys of queryParams
+	Query []string
+	// zero value of the request body type, nil if there is none
+	Body interface{}
+	// the request body may be left out
+	BodyOptional bool
+	// zero value of the response body type, nil for 204 No Content
+	Response interface{}
+	// status of a success when not 200
+	Status int
+	// of the response body when not JSON
+	ContentType string
+}
+
+// Bodies and responses without a type of their own
+type (
+	// a JSON Merge Patch
+	mergePatch map[string]interface{}
+	// Cypher property map, Ex. {name: "Jon Snow"}
+	cypherProps string
+	postVotes   struct {
+		Votes int `json:"votes"`
+	}
+	votedPost struct {
+		Id string `json:"id"`
+	}
+	// what WriteError sends
+	errorBody struct {
+		Code      string       `json:"code"`
+		Message   string       `json:"message"`
+		Details   []FieldError `json:"details"`
+		RequestID string       `json:"requestId"`
+	}
+)
+
+type queryParam struct {
+	Type        string
+	Description string
+	Enum        []string
+}
+
+var queryParams = map[string]queryParam{
+	"skip":       {"integer", "Number of results to skip", nil},
+	"limit":      {"integer", "Largest number of results", nil},
+	"cursor":     {"string", "Where the previous page ended, its nextCursor", nil},
+	"window":     {"string", "Age of the posts ranked", []string{"day", "week", "all"}},
+	"depth":      {"integer", "Levels to follow", nil},
+	"format":     {"string", "Shape of the graph", []string{"json", "cytoscape", "d3"}},
+	"types":      {"string", "Relationship types to follow, comma separated", nil},
+	"collection": {"string", "Only this collection", nil},
+	"status":     {"string", "Only reports in this status", []string{"open", "actioned", "dismissed"}},
+	"votes":      {"boolean", "Blend in posts the followed users voted for", nil},
+	"maxDepth":   {"integer", "Longest path searched", nil},
+	"all":        {"boolean", "All the shortest paths, not just one", nil},
+	"orderBy":    {"string", "Property to order by", nil},
+	"desc":       {"boolean", "Order descending", nil},
+}
+
+// Every route registered on the router, by method and path as registered
+var routeDocs = map[string]RouteDoc{
+	"GET /healthz":      {Summary: "The process is alive", Response: map[string]string{}},
+	"GET /readyz":       {Summary: "Neo4j answers a query, 503 if not", Response: Readiness{}},
+	"GET /version":      {Summary: "Build version, commit and time", Response: VersionInfo{}},
+	"GET /metrics":      {Summary: "Prometheus metrics", Response: "", ContentType: "text/plain"},
+	"GET /openapi.json": {Summary: "This document", Response: map[string]interface{}{}},
+	"GET /docs":         {Summary: "Interactive documentation of the API", Response: "", ContentType: "text/html"},
+
+	"GET /users":                       {Summary: "Get all users", Response: []UserSummary{}},
+	"GET /users/:id":                   {Summary: "Get a user by id", Response: []User{}},
+	"POST /users/query":                {Summary: "Get users by multiple properties", Body: cypherProps(""), Response: []UserSummary{}},
+	"POST /users":                      {Summary: "Create a user", Body: UserRequest{}, Response: []User{}},
+	"PUT /users/:id":                   {Summary: "Update a user", Body: UserRequest{}, Response: []User{}},
+	"PATCH /users/:id":                 {Summary: "Partially update a user", Body: mergePatch{}, Response: []User{}},
+	"DELETE /users/:id":                {Summary: "Delete a user and its relationships"},
+	"GET /users/:id/votes":             {Summary: "Get the posts a user voted", Response: []votedPost{}},
+	"PUT /users/:id/follow":            {Summary: "Follow a user", Body: UserIdRequest{}, Response: FollowRel{}},
+	"DELETE /users/:id/follow":         {Summary: "Unfollow a user", Body: UserIdRequest{}},
+	"GET /users/:id/followers":         {Summary: "Get a user's followers", Query: []string{"skip", "limit"}, Response: []UserSummary{}},
+	"GET /users/:id/following":         {Summary: "Get the users a user follows", Query: []string{"skip", "limit"}, Response: []UserSummary{}},
+	"GET /users/:id/recommendations":   {Summary: "Get users to follow", Query: []string{"limit"}, Response: []UserRecommendation{}},
+	"GET /users/:id/mutual/:otherId":   {Summary: "Get users followed by both users", Response: MutualConnections{}},
+	"GET /users/:id/recommended-posts": {Summary: "Get posts voted by users with similar votes", Query: []string{"limit"}, Response: []PostRecommendation{}},
+	"PUT /users/:id/block":             {Summary: "Block a user", Body: UserIdRequest{}, Response: UserRel{}},
+	"DELETE /users/:id/block":          {Summary: "Unblock a user", Body: UserIdRequest{}},
+	"GET /users/:id/blocks":            {Summary: "Get the users a user blocked", Query: []string{"skip", "limit"}, Response: []UserSummary{}},
+	"PUT /users/:id/mute":              {Summary: "Mute a user", Body: UserIdRequest{}, Response: UserRel{}},
+	"DELETE /users/:id/mute":           {Summary: "Unmute a user", Body: UserIdRequest{}},
+	"GET /users/:id/mutes":             {Summary: "Get the users a user muted", Query: []string{"skip", "limit"}, Response: []UserSummary{}},
+	"GET /users/:id/saved":             {Summary: "Get a user's saved posts by collection", Query: []string{"collection", "skip", "limit"}, Response: []SavedCollection{}},
+	"POST /users/:id/report":           {Summary: "Report a user", Body: ReportRequest{}, Response: Report{}, Status: http.StatusCreated},
+
+	"GET /posts":                                {Summary: "Get all posts", Response: []Post{}},
+	"GET /posts/hot":                            {Summary: "Get posts by hot score", Query: []string{"window", "skip", "limit"}, Response: []Post{}},
+	"GET /posts/trending":                       {Summary: "Get posts by gravity score", Query: []string{"window", "skip", "limit"}, Response: []Post{}},
+	"GET /posts/:id":                            {Summary: "Get a post by id", Response: []Post{}},
+	"POST /posts/query":                         {Summary: "Get posts by multiple properties", Query: []string{"orderBy", "desc", "skip", "limit"}, Body: cypherProps(""), Response: []Post{}},
+	"POST /posts":                               {Summary: "Create a post", Body: PostRequest{}, Response: []Post{}},
+	"PUT /posts/:id":                            {Summary: "Update a post, or create it", Body: PostRequest{}, Response: []Post{}},
+	"PATCH /posts/:id":                          {Summary: "Partially update a post", Body: mergePatch{}, Response: []Post{}},
+	"DELETE /posts/:id":                         {Summary: "Delete a post"},
+	"PUT /posts/:id/vote":                       {Summary: "Vote a post", Body: VoteRequest{}},
+	"DELETE /posts/:id/vote":                    {Summary: "Take back a vote on a post", Body: VoteRequest{}},
+	"GET /posts/:id/vote":                       {Summary: "Get a post's votes", Response: []postVotes{}},
+	"POST /posts/:id/report":                    {Summary: "Report a post", Body: ReportRequest{}, Response: Report{}, Status: http.StatusCreated},
+	"PUT /posts/:id/save":                       {Summary: "Save a post to a collection", Body: SaveRequest{}, BodyOptional: true, Response: SavedPost{}},
+	"DELETE /posts/:id/save":                    {Summary: "Unsave a post"},
+	"POST /posts/:id/publish":                   {Summary: "Publish a post, or schedule it", Body: PublishRequest{}, BodyOptional: true, Response: []Post{}},
+	"POST /posts/:id/unpublish":                 {Summary: "Move a post back to draft", Response: []Post{}},
+	"POST /posts/:id/archive":                   {Summary: "Archive a post", Response: []Post{}},
+	"GET /posts/:id/revisions":                  {Summary: "Get a post's previous revisions", Response: []Revision{}},
+	"GET /posts/:id/revisions/:rev":             {Summary: "Get a revision of a post", Response: Revision{}},
+	"GET /posts/:id/revisions/:rev/diff/:other": {Summary: "Diff two revisions, current for the post as it is", Response: RevisionDiff{}},
+	"POST /posts/:id/revisions/:rev/restore":    {Summary: "Restore a post to a revision", Response: []Post{}},
+	"GET /posts/:id/comments":                   {Summary: "Get a post's comment threads", Query: []string{"depth"}, Response: []Comment{}},
+	"POST /posts/:id/comments":                  {Summary: "Comment on a post, or reply to a comment", Body: CommentRequest{}, Response: Comment{}, Status: http.StatusCreated},
+	"GET /posts/:id/comments/:cid":              {Summary: "Get a comment", Response: Comment{}},
+	"PUT /posts/:id/comments/:cid":              {Summary: "Update a comment's body", Body: CommentUpdateRequest{}, Response: Comment{}},
+	"DELETE /posts/:id/comments/:cid":           {Summary: "Delete a comment"},
+	"PUT /posts/:id/comments/:cid/vote":         {Summary: "Vote a comment", Body: CommentVoteRequest{}},
+	"DELETE /posts/:id/comments/:cid/vote":      {Summary: "Take back a vote on a comment", Body: VoteRequest{}},
+
+	"GET /feed":                    {Summary: "Get posts by followed users, newest first", Query: []string{"votes", "cursor", "limit"}, Response: FeedPage{}},
+	"GET /tags":                    {Summary: "Get all tags with their post counts", Response: []Tag{}},
+	"GET /tags/:slug/posts":        {Summary: "Get the posts tagged with a tag", Query: []string{"skip", "limit"}, Response: []Post{}},
+	"GET /tags/:slug/related":      {Summary: "Get tags often used together with a tag", Query: []string{"limit"}, Response: []Tag{}},
+	"GET /relation/:id1/:id2/path": {Summary: "Get the shortest path between nodes", Query: []string{"maxDepth", "types", "all"}, Response: PathResult{}},
+	"GET /graph/:id":               {Summary: "Get the nodes and relationships around a node", Query: []string{"depth", "types", "limit", "format"}, Response: Graph{}},
+
+	"GET /moderation/reports":              {Summary: "Get reports, most reported first", Query: []string{"status", "skip", "limit"}, Response: []Report{}},
+	"PUT /moderation/reports/:rid":         {Summary: "Action or dismiss a report", Body: ResolveRequest{}},
+	"POST /moderation/posts/:id/hide":      {Summary: "Hide a post", Body: NoteRequest{}, BodyOptional: true},
+	"POST /moderation/posts/:id/unhide":    {Summary: "Unhide a post", Body: NoteRequest{}, BodyOptional: true},
+	"POST /moderation/users/:id/suspend":   {Summary: "Suspend a user", Body: NoteRequest{}, BodyOptional: true},
+	"POST /moderation/users/:id/unsuspend": {Summary: "Lift a user's suspension", Body: NoteRequest{}, BodyOptional: true},
+}
+
+var openAPISpec []byte
+
+// Build the document of `routes`, Ex. "GET /posts/:id". A route without
+// an entry in routeDocs, or an entry without a route, is an error so the
+// document can't drift from the router.
+func BuildOpenAPI(routes []string) error {
+	var problems []string
+	registered := map[string]bool{}
+	for _, route := range routes {
+		registered[route] = true
+		if _, ok := routeDocs[route]; !ok {
+			problems = append(problems, route+" is not documented")
+		}
+	}
+	for route := range routeDocs {
+		if !registered[route] {
+			problems = append(problems, route+" is documented but not registered")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("openapi:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	s := schemas{}
+	paths := map[string]map[string]interface{}{}
+	for _, route := range routes {
+		method, path := splitRoute(route)
+		specPath, params := openAPIPath(path)
+		if paths[specPath] == nil {
+			paths[specPath] = map[string]interface{}{}
+		}
+		paths[specPath][strings.ToLower(method)] = s.operation(method, path, routeDocs[route], params)
+	}
+
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   serviceName,
+			"version": BuildVersion,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": s,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "Error",
+					"content":     s.content("", errorBody{}),
+				},
+			},
+			// not authentication yet, see callerId
+			"securitySchemes": map[string]interface{}{
+				"userId": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-User-Id"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{}, map[string]interface{}{"userId": []string{}}},
+	}
+
+	var err error
+	openAPISpec, err = json.MarshalIndent(spec, "", "  ")
+	return err
+}
+
+// Ex. "GET /posts/:id" -> "GET", "/posts/:id"
+func splitRoute(route string) (string, string) {
+	i := strings.Index(route, " ")
+	return route[:i], route[i+1:]
+}
+
+// Ex. /posts/:id/comments/:cid -> /posts/{id}/comments/{cid}, [id cid]
+func openAPIPath(path string) (string, []string) {
+	var params []string
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			params = append(params, segment[1:])
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// The operation object of a route
+func (s schemas) operation(method string, path string, doc RouteDoc, pathParams []string) map[string]interface{} {
+	var params []interface{}
+	for _, name := range pathParams {
+		params = append(params, map[string]interface{}{
+			"name": name, "in": "path", "required": true,
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, name := range doc.Query {
+		p := queryParams[name]
+		schema := map[string]interface{}{"type": p.Type}
+		if p.Enum != nil {
+			schema["enum"] = p.Enum
+		}
+		params = append(params, map[string]interface{}{
+			"name": name, "in": "query", "description": p.Description, "schema": schema,
+		})
+	}
+
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if doc.Response == nil {
+		status = http.StatusNoContent
+		success["description"] = http.StatusText(status)
+	} else {
+		success["content"] = s.content(doc.ContentType, doc.Response)
+	}
+
+	op := map[string]interface{}{
+		"summary":     doc.Summary,
+		"operationId": operationId(method, path),
+		"tags":        []string{strings.Split(path, "/")[1]},
+		"responses": map[string]interface{}{
+			strconv.Itoa(status): success,
+			"default":            map[string]interface{}{"$ref": "#/components/responses/Error"},
+		},
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+	if doc.Body != nil {
+		contentType := "application/json"
+		switch doc.Body.(type) {
+		case mergePatch:
+			contentType = "application/merge-patch+json"
+		case cypherProps:
+			contentType = "text/plain"
+		}
+		op["requestBody"] = map[string]interface{}{
+			"required": !doc.BodyOptional,
+			"content":  s.content(contentType, doc.Body),
+		}
+	}
+	return op
+}
+
+func (s schemas) content(contentType string, v interface{}) map[string]interface{} {
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return map[string]interface{}{contentType: map[string]interface{}{"schema": s.of(reflect.TypeOf(v))}}
+}
+
+// Ex. GET /posts/:id/comments -> getPostsIdComments
+func operationId(method string, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(c rune) bool { return strings.ContainsRune("/:-.*", c) }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// Schemas of the named struct types met, by name
+type schemas map[string]interface{}
+
+// The schema of `t`. Named structs are added to `s` and referenced.
+func (s schemas) of(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.of(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Map:
+		schema := map[string]interface{}{"type": "object"}
+		if t.Elem().Kind() != reflect.Interface {
+			schema["additionalProperties"] = s.of(t.Elem())
+		}
+		return schema
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := s[name]; !ok {
+			// placeholder first, for types referring to themselves
+			s[name] = nil
+			s[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	// interface{}, anything
+	return map[string]interface{}{}
+}
+
+// The object schema of struct `t`, from its json and validate tags
+func (s schemas) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		prop := s.of(f.Type)
+		for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+			rule, arg := rule, ""
+			if i := strings.Index(rule, "="); i >= 0 {
+				rule, arg = rule[:i], rule[i+1:]
+			}
+			n, _ := strconv.Atoi(arg)
+			switch {
+			case rule == "required":
+				required = append(required, name)
+			case rule == "email":
+				prop["format"] = "email"
+			case rule == "oneof":
+				prop["enum"] = strings.Split(arg, "|")
+			case rule == "min" && f.Type.Kind() == reflect.String:
+				prop["minLength"] = n
+			case rule == "max" && f.Type.Kind() == reflect.String:
+				prop["maxLength"] = n
+			case rule == "min":
+				prop["minItems"] = n
+			case rule == "max":
+				prop["maxItems"] = n
+			}
+		}
+		properties[name] = prop
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// handler for GET /openapi.json
+func OpenAPIGet(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write(openAPISpec)
+	return http.StatusOK, err
+}
+
+var (
+	// Redoc bundle rendering /openapi.json on /docs, pinned to a version
+	DocsScript = "https://cdn.jsdelivr.net/npm/redoc@2.1.5/bundles/redoc.standalone.js"
+	// Subresource Integrity hash of DocsScript, Ex. "sha384-...", the
+	// browser refuses a script not matching it
+	DocsIntegrity = ""
+)
+
+var docsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{.Title}} API</title>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+</head>
+<body>
+<redoc spec-url="/openapi.json"></redoc>
+<script src="{{.Script}}"{{with .Integrity}} integrity="{{.}}" crossorigin="anonymous"{{end}}></script>
+</body>
+</html>
+`))
+
+// handler for GET /docs
+func DocsGet(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return http.StatusOK, docsPage.Execute(w, struct {
+		Title, Script, Integrity string
+	}{serviceName, DocsScript, DocsIntegrity})
+}
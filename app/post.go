@@ -3,7 +3,6 @@ package app
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -20,8 +19,12 @@ type Post struct {
 	Upvotes          int                    `json:"upvotes"`
 	Downvotes        int                    `json:"downvotes"`
 	ViewCount        int                    `json:"viewCount"`
+	CommentCount     int                    `json:"commentCount"`
+	Tags             []string               `json:"tags"`
 	CreateTime       int                    `json:"createTime"`
 	LastModifiedTime int                    `json:"lastModifiedTime"`
+	Version          int                    `json:"version"`
+	Score            float64                `json:"score,omitempty"`
 }
 
 type VoteRel struct {
@@ -33,11 +36,9 @@ type VoteRel struct {
 func PostGetAll(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
 	postGetAll := `
 		MATCH (author:USER)-[r:CREATED]->(p:POST)
-		RETURN p.id as id, p.title as title, p.type as type,
-		p.body as body, p.status as status, p.publishDate as publishDate,
-		p.upvotes as upvotes, p.downvotes as downvotes,
-		p.viewCount as viewCount, r.createTime as createTime,
-		p.lastModifiedTime as lastModifiedTime, author
+		WHERE (coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR author.id = {caller})
+		AND NOT (author)-[:BLOCKS]->(:USER {id: {caller}})
+		RETURN ` + POST_COLUMNS + `, p.publishDate as publishDate
 	`
 
 	queryReqPostGetAll := QueryRequest{
@@ -45,7 +46,7 @@ func PostGetAll(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 		Result: &[]Post{},
 		Query: MakeQuery(
 			postGetAll,
-			nil,
+			Props{"caller": callerId(r)},
 			nil,
 		),
 	}
@@ -55,7 +56,6 @@ func PostGetAll(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	log.Println(result.Result)
 	var res interface{}
 	res, err = getAuthorData(result.Result)
 	if err != nil {
@@ -68,16 +68,14 @@ func PostGetAll(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 func PostGetOne(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
 	postFindById := `
 		MATCH (author:USER)-[r:CREATED]->(p:POST {id:{id}})
-		RETURN p.id as id, p.title as title, p.type as type,
-		p.body as body, p.status as status, p.publishDate as publishDate,
-		p.upvotes as upvotes, p.downvotes as downvotes,
-		p.viewCount as viewCount, r.createTime as createTime,
-		p.lastModifiedTime as lastModifiedTime, author
+		WHERE (coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR author.id = {caller})
+		AND NOT (author)-[:BLOCKS]->(:USER {id: {caller}})
+		RETURN ` + POST_COLUMNS + `, p.publishDate as publishDate
 	`
 	queryReqPostFindById := QueryRequest{
 		Name:   "find-post-by-id",
 		Result: &[]Post{},
-		Query:  MakeQuery(postFindById, Props{"id": ps.ByName("id")}, nil),
+		Query:  MakeQuery(postFindById, Props{"id": ps.ByName("id"), "caller": callerId(r)}, nil),
 	}
 
 	result := QueryResult{}
@@ -85,6 +83,11 @@ func PostGetOne(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	posts := *result.Result.(*[]Post)
+	if len(posts) == 0 {
+		return http.StatusNotFound, NotFound("post")
+	}
+	setETag(w, posts[0].Version)
 	var res interface{}
 	res, err = getAuthorData(result.Result)
 	if err != nil {
@@ -97,19 +100,15 @@ func PostGetOne(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 func PostQuery(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
 	// able to get query string later
 	r.ParseForm()
-	body, err := getReqBody(r)
+	body, err := getReqBody(w, r)
 	if err != nil {
 		return http.StatusBadRequest, err
 	}
-	log.Println("query body: " + body)
-
 	postFind := `
 		MATCH (author:USER)-[r:CREATED]->(p:POST` + body + `)
-		RETURN p.id as id, p.title as title, p.type as type,
-		p.body as body, p.status as status, p.publishDate as publishDate,
-		p.upvotes as upvotes, p.downvotes as downvotes,
-		p.viewCount as viewCount, r.createTime as createTime,
-		p.lastModifiedTime as lastModifiedTime, author
+		WHERE (coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR author.id = {caller})
+		AND NOT (author)-[:BLOCKS]->(:USER {id: {caller}})
+		RETURN ` + POST_COLUMNS + `, p.publishDate as publishDate
 	`
 	if order := r.Form.Get("orderBy"); order != "" {
 		postFind += "\nORDER BY p." + order
@@ -123,12 +122,11 @@ func PostQuery(context *AppContext, w http.ResponseWriter, r *http.Request, ps h
 	if limit := r.Form.Get("limit"); limit != "" {
 		postFind += "\nLIMIT " + limit
 	}
-	log.Println(postFind)
 
 	queryReqFindPost := QueryRequest{
 		Name:   "find-post",
 		Result: &[]Post{},
-		Query:  MakeQuery(postFind, nil, nil),
+		Query:  MakeQuery(postFind, Props{"caller": callerId(r)}, nil),
 	}
 
 	result := QueryResult{}
@@ -146,20 +144,54 @@ func PostQuery(context *AppContext, w http.ResponseWriter, r *http.Request, ps h
 }
 
 // handler for POST /posts
+// Create a post, the id must not be taken. An id is generated when none is
+// given.
 func PostCreate(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
-	var props map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&props)
-	log.Printf("query map: %v\n", props)
+	var body PostRequest
+	err := decodeBody(w, r, &body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if body.Id == "" {
+		body.Id = newId()
+	}
+
+	status, publishDate, err := initialPostStatus(body.Status, body.PublishDate)
+	if err != nil {
+		return http.StatusBadRequest, Validation("invalid request body", FieldError{"status", err.Error()})
+	}
+	tags, err := postTags(body.Tags)
+	if err != nil {
+		return http.StatusBadRequest, Validation("invalid request body", FieldError{"tags", err.Error()})
+	}
+	suspended, err := userSuspended(context, body.Author)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if suspended {
+		return http.StatusForbidden, Forbidden("suspended users cannot create posts")
+	}
+	findDuplicate := `
+		MATCH (p:POST {id: {id}})
+		RETURN p.id as id
+	`
+	taken, err := anyRow(context, "find-duplicate-post", findDuplicate, Props{"id": body.Id})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if taken {
+		return http.StatusConflict, Conflict("a post with this id already exists")
+	}
 
 	postCreate := `
 		MATCH (author:USER {id:{uid}})
 		CREATE (author)-[r:CREATED {createTime: timestamp()}]->(p:POST {props})
-		SET p.publishDate = r.createTime
-		RETURN p.id as id, p.title as title, p.type as type,
-		p.body as body, p.status as status, p.publishDate as publishDate,
-		p.upvotes as upvotes, p.downvotes as downvotes,
-		p.viewCount as viewCount, r.createTime as createTime,
-		p.lastModifiedTime as lastModifiedTime, author
+		SET p.id = {id}, p.upvotes = 0, p.downvotes = 0, p.viewCount = 0,
+		p.status = {status},
+		p.publishDate = CASE WHEN {status} = 'draft' THEN null
+			ELSE coalesce({publishDate}, r.createTime) END
+	` + SET_POST_TAGS + `
+		RETURN ` + POST_COLUMNS + `, p.publishDate as publishDate
 	`
 
 	queryReqCreatePost := QueryRequest{
@@ -167,7 +199,14 @@ func PostCreate(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 		Result: &[]Post{},
 		Query: MakeQuery(
 			postCreate,
-			Props{"uid": props["author"], "props": props},
+			Props{
+				"uid":         body.Author,
+				"id":          body.Id,
+				"props":       body.props(),
+				"status":      status,
+				"publishDate": publishDate,
+				"tags":        tags,
+			},
 			nil,
 		),
 	}
@@ -189,38 +228,82 @@ func PostCreate(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 
 // handler for PUT /posts/:id
 // This will update the post or create one if not exists
+// Note: status and publish date only change through the lifecycle
+// endpoints, a newly created post starts as draft.
 func PostUpdate(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
-	var props map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&props)
-	log.Printf("query map: %v\n", props)
+	var body PostRequest
+	err := decodeBody(w, r, &body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	var lifecycle []FieldError
+	if body.Status != "" {
+		lifecycle = append(lifecycle, FieldError{"status", "changes through the lifecycle endpoints"})
+	}
+	if body.PublishDate != nil {
+		lifecycle = append(lifecycle, FieldError{"publishDate", "changes through the lifecycle endpoints"})
+	}
+	if body.Id != "" && body.Id != ps.ByName("id") {
+		lifecycle = append(lifecycle, FieldError{"id", "must match the id in the path"})
+	}
+	if len(lifecycle) > 0 {
+		return http.StatusBadRequest, Validation("invalid request body", lifecycle...)
+	}
+	// like other properties, tags left out of a PUT are removed
+	tags, err := postTags(body.Tags)
+	if err != nil {
+		return http.StatusBadRequest, Validation("invalid request body", FieldError{"tags", err.Error()})
+	}
+
+	editor := callerId(r)
+	if editor == "" {
+		editor = body.Author
+	}
 
 	updateOrCreatePost := `
 		MATCH (author:USER {id:{uid}})
 		MERGE (author)-[r:CREATED]->(p:POST {id:{id}})
-		ON CREATE SET p={props}, r.createTime=timestamp()
-		ON MATCH SET p={props}, p.lastModifiedTime=timestamp()
-		RETURN p.id as id, p.title as title, p.type as type,
-		p.body as body, p.status as status, p.publishDate as publishDate,
-		p.upvotes as upvotes, p.downvotes as downvotes,
-		p.viewCount as viewCount, r.createTime as createTime,
-		p.lastModifiedTime as lastModifiedTime, author 
+		ON CREATE SET r.createTime=timestamp(), p.status='draft'
+		ON MATCH SET p.lastModifiedTime=timestamp()
+		WITH author, r, p, p.status as status, p.publishDate as publishDate,
+		p.lastModifiedTime as lastModifiedTime, coalesce(p.version, 0) as version,
+		p.revisions as revisions, p.hidden as hidden,
+		coalesce(p.upvotes, 0) as upvotes, coalesce(p.downvotes, 0) as downvotes,
+		coalesce(p.viewCount, 0) as viewCount
+		SET p={props}, p.id={id}, p.status=status, p.publishDate=publishDate,
+		p.lastModifiedTime=lastModifiedTime, p.version=version + 1,
+		p.revisions=revisions, p.hidden=hidden,
+		p.upvotes=upvotes, p.downvotes=downvotes, p.viewCount=viewCount
+	` + SET_POST_TAGS + `
+		RETURN ` + POST_COLUMNS + `, p.publishDate as publishDate
 	`
 	queryReqPostUpdateOrCreate := QueryRequest{
 		Name:   "update-or-create-post",
 		Result: &[]Post{},
 		Query: MakeQuery(
 			updateOrCreatePost,
-			Props{"uid": props["author"], "id": ps.ByName("id"), "props": props},
+			Props{
+				"uid":   body.Author,
+				"id":    ps.ByName("id"),
+				"props": body.props(),
+				"tags":  tags,
+			},
 			nil,
 		),
 	}
-	result := QueryResult{}
-	err = context.DB.RunSingleQuery(queryReqPostUpdateOrCreate, &result)
+	// keep the previous content as a revision
+	results, err := context.DB.RunTransaction([]QueryRequest{
+		snapshotPostQuery(ps.ByName("id"), editor, nil),
+		queryReqPostUpdateOrCreate,
+	})
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	if posts := *results[1].Result.(*[]Post); len(posts) == 1 {
+		setETag(w, posts[0].Version)
+	}
 	var res interface{}
-	res, err = getAuthorData(result.Result)
+	res, err = getAuthorData(results[1].Result)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
@@ -228,17 +311,84 @@ func PostUpdate(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 	return http.StatusOK, json.NewEncoder(w).Encode(res)
 }
 
+// handler for PATCH /posts/:id
+// Apply a JSON Merge Patch to the post, properties set to null are
+// removed and the ones left out are kept. Send the ETag in `If-Match` to
+// refuse the patch when someone else changed the post meanwhile.
+func PostPatch(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	props, err := decodePatch(w, r, &PostRequest{}, "id", "author", "version", "revisions", "status", "publishDate", "hidden",
+		"upvotes", "downvotes", "viewCount", "createTime", "lastModifiedTime")
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	tags, err := parsePostTags(props)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	id := ps.ByName("id")
+	versions := parseIfMatch(r)
+	// lock before reading the version, see UserPatch
+	patchPost := `
+		MATCH (author:USER)-[r:CREATED]->(p:POST {id:{id}})
+		SET p._lock = true REMOVE p._lock
+		WITH author, r, p
+		WHERE {versions} IS NULL OR coalesce(p.version, 0) IN {versions}
+		SET p += {props}, p.version = coalesce(p.version, 0) + 1,
+		p.lastModifiedTime = timestamp()
+	` + SET_POST_TAGS + `
+		RETURN ` + POST_COLUMNS + `, p.publishDate as publishDate
+	`
+	queryReqPatchPost := QueryRequest{
+		Name:   "patch-post",
+		Result: &[]Post{},
+		Query: MakeQuery(
+			patchPost,
+			Props{"id": id, "props": props, "versions": versions, "tags": tags},
+			nil,
+		),
+	}
+
+	// keep the previous content as a revision
+	results, err := context.DB.RunTransaction([]QueryRequest{
+		snapshotPostQuery(id, callerId(r), versions),
+		queryReqPatchPost,
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	posts := *results[1].Result.(*[]Post)
+	if len(posts) == 0 {
+		return preconditionStatus(context, "POST", id)
+	}
+	setETag(w, posts[0].Version)
+
+	var res interface{}
+	res, err = getAuthorData(results[1].Result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, json.NewEncoder(w).Encode(res)
+}
+
 // handler for DELETE /posts/:id
 func PostDestroy(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
 	postDestroy := `
 		MATCH (p:POST {id:{id}})
-		DETACH DELETE p
+		OPTIONAL MATCH (p)-[:HAS_REVISION]->(rev:REVISION)
+		OPTIONAL MATCH (c:COMMENT)-[:ON]->(p)
+		WITH p, p.id as id, rev, c
+		DETACH DELETE p, rev, c
+		RETURN DISTINCT id
 	`
 
 	queryReqPostDestroy := QueryRequest{
-		Name:   "delete-post",
-		Result: nil,
-		Query:  MakeQuery(postDestroy, Props{"id": ps.ByName("id")}, nil),
+		Name: "delete-post",
+		Result: &[]struct {
+			Id string `json:"id"`
+		}{},
+		Query: MakeQuery(postDestroy, Props{"id": ps.ByName("id")}, nil),
 	}
 
 	result := QueryResult{}
@@ -246,20 +396,40 @@ func PostDestroy(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	if len(*result.Result.(*[]struct {
+		Id string `json:"id"`
+	})) == 0 {
+		return http.StatusNotFound, NotFound("post")
+	}
 
-	return http.StatusOK, json.NewEncoder(w).Encode("Delete post ok.")
+	return noContent(w)
 }
 
 // vote a post
 func PostVote(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
-	var props map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&props)
+	var body VoteRequest
+	err := decodeBody(w, r, &body)
 	if err != nil {
-		log.Println("Parse request body error.")
+		return http.StatusBadRequest, err
+	}
+	uid := body.Id
+	blocked, err := postAuthorBlocks(context, ps.ByName("id"), uid)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if blocked {
+		return http.StatusForbidden, Forbidden("blocked by the post's author")
+	}
+	suspended, err := userSuspended(context, uid)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if suspended {
+		return http.StatusForbidden, Forbidden("suspended users cannot vote")
 	}
 
 	postVote := `
-		MATCH (u:USER {id: {props}.id}), (p:POST {id: {id}})
+		MATCH (u:USER {id: {uid}}), (p:POST {id: {id}})
 		MERGE (u)-[r:VOTED]->(p)
 		ON CREATE SET r.created=timestamp(), r.found=false, p.upvotes=p.upvotes+1
 		ON MATCH SET r.found=true
@@ -271,7 +441,7 @@ func PostVote(context *AppContext, w http.ResponseWriter, r *http.Request, ps ht
 		Result: &[]VoteRel{},
 		Query: MakeQuery(
 			postVote,
-			Props{"id": ps.ByName("id"), "props": props},
+			Props{"id": ps.ByName("id"), "uid": uid},
 			nil,
 		),
 	}
@@ -281,19 +451,19 @@ func PostVote(context *AppContext, w http.ResponseWriter, r *http.Request, ps ht
 		return http.StatusInternalServerError, err
 	}
 
-	return http.StatusNoContent, json.NewEncoder(w).Encode("Vote post ok.")
+	return noContent(w)
 }
 
 // devote a post
 func PostDeleteVote(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
-	var props map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&props)
+	var body VoteRequest
+	err := decodeBody(w, r, &body)
 	if err != nil {
-		log.Println("Parse request body error.")
+		return http.StatusBadRequest, err
 	}
 
 	postDeleteVote := `
-		MATCH (u:USER {id: {props}.id})-[r:VOTED]->(p:POST {id: {id}})
+		MATCH (u:USER {id: {uid}})-[r:VOTED]->(p:POST {id: {id}})
 		SET p.upvotes=p.upvotes-1
 		DELETE r
 	`
@@ -301,7 +471,7 @@ func PostDeleteVote(context *AppContext, w http.ResponseWriter, r *http.Request,
 	queryReqPostDeleteVote := QueryRequest{
 		Name:   "delete-post-vote",
 		Result: nil,
-		Query:  MakeQuery(postDeleteVote, Props{"id": ps.ByName("id"), "props": props}, nil),
+		Query:  MakeQuery(postDeleteVote, Props{"id": ps.ByName("id"), "uid": body.Id}, nil),
 	}
 
 	result := QueryResult{}
@@ -310,7 +480,7 @@ func PostDeleteVote(context *AppContext, w http.ResponseWriter, r *http.Request,
 		return http.StatusInternalServerError, err
 	}
 
-	return http.StatusOK, json.NewEncoder(w).Encode("Delete post vote ok.")
+	return noContent(w)
 }
 
 // get a post's vote count
@@ -333,6 +503,11 @@ func PostGetVote(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	if len(*result.Result.(*[]struct {
+		Votes int `json:"votes"`
+	})) == 0 {
+		return http.StatusNotFound, NotFound("post")
+	}
 
 	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
 }
@@ -0,0 +1,262 @@
+// post lifecycle: draft -> scheduled -> published -> archived
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Values of `Post.Status`
+const (
+	PostStatusDraft     = "draft"
+	PostStatusScheduled = "scheduled"
+	PostStatusPublished = "published"
+	PostStatusArchived  = "archived"
+)
+
+// Allowed transitions, keyed by the current status.
+// Note: posts created before the lifecycle existed have no status and are
+// treated as published.
+var postTransitions = map[string][]string{
+	PostStatusDraft:     {PostStatusScheduled, PostStatusPublished, PostStatusArchived},
+	PostStatusScheduled: {PostStatusDraft, PostStatusScheduled, PostStatusPublished, PostStatusArchived},
+	PostStatusPublished: {PostStatusDraft, PostStatusArchived},
+	PostStatusArchived:  {},
+}
+
+// Return the statuses from which a post may move to `to`
+func postStatusesLeadingTo(to string) []string {
+	from := []string{}
+	for status, targets := range postTransitions {
+		for _, t := range targets {
+			if t == to {
+				from = append(from, status)
+				break
+			}
+		}
+	}
+	return from
+}
+
+// Current time in milliseconds, the unit of neo4j's timestamp()
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Work out the status a new post asking for `status` starts in, and its
+// publish date
+func initialPostStatus(status string, publishDate *int64) (string, interface{}, error) {
+	switch status {
+	case "", PostStatusDraft:
+		return PostStatusDraft, nil, nil
+	case PostStatusPublished, PostStatusScheduled:
+		if publishDate != nil && *publishDate > nowMillis() {
+			return PostStatusScheduled, *publishDate, nil
+		}
+		if status == PostStatusScheduled {
+			return "", nil, errors.New("scheduled post needs a future publishDate")
+		}
+		if publishDate != nil {
+			return PostStatusPublished, *publishDate, nil
+		}
+		return PostStatusPublished, nil, nil
+	}
+	return "", nil, fmt.Errorf("invalid initial status %q", status)
+}
+
+// handler for POST /posts/:id/publish
+// Publish the post now, or schedule it when the body carries a future
+// `publishDate`.
+func PostPublish(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	var body PublishRequest
+	if err := decodeOptionalBody(w, r, &body); err != nil {
+		return http.StatusBadRequest, err
+	}
+	var publishDate interface{}
+	if body.PublishDate != nil {
+		publishDate = *body.PublishDate
+	}
+
+	to := PostStatusPublished
+	if body.PublishDate != nil && *body.PublishDate > nowMillis() {
+		to = PostStatusScheduled
+	}
+	return postTransition(context, w, ps.ByName("id"), to,
+		"p.publishDate = coalesce({publishDate}, timestamp())",
+		Props{"publishDate": publishDate})
+}
+
+// handler for POST /posts/:id/unpublish
+// Move a published or scheduled post back to draft.
+func PostUnpublish(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	return postTransition(context, w, ps.ByName("id"), PostStatusDraft,
+		"p.publishDate = null", Props{})
+}
+
+// handler for POST /posts/:id/archive
+func PostArchive(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	return postTransition(context, w, ps.ByName("id"), PostStatusArchived, "", Props{})
+}
+
+// Move post `id` to status `to`. `set` is an extra SET expression applied
+// along with the status change.
+func postTransition(context *AppContext, w http.ResponseWriter, id string, to string, set string, params Props) (int, error) {
+	postTransit := `
+		MATCH (author:USER)-[r:CREATED]->(p:POST {id:{id}})
+		WHERE coalesce(p.status, 'published') IN {from}
+		SET p.status = {to}, p.lastModifiedTime = timestamp(),
+		p.version = coalesce(p.version, 0) + 1`
+	if set != "" {
+		postTransit += ", " + set
+	}
+	postTransit += `
+		RETURN ` + POST_COLUMNS + `, p.publishDate as publishDate
+	`
+	params["id"] = id
+	params["to"] = to
+	params["from"] = postStatusesLeadingTo(to)
+
+	queryReqPostTransit := QueryRequest{
+		Name:   "post-transit-" + to,
+		Result: &[]Post{},
+		Query:  MakeQuery(postTransit, params, nil),
+	}
+
+	result := QueryResult{}
+	err := context.DB.RunSingleQuery(queryReqPostTransit, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	posts := *result.Result.(*[]Post)
+	if len(posts) == 0 {
+		status, err := postCurrentStatus(context, id)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if status == "" {
+			return http.StatusNotFound, NotFound("post")
+		}
+		return http.StatusConflict, Conflict(fmt.Sprintf("post in status %q cannot become %q", status, to))
+	}
+	setETag(w, posts[0].Version)
+
+	var res interface{}
+	res, err = getAuthorData(result.Result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, json.NewEncoder(w).Encode(res)
+}
+
+// Get the current status of a post, empty if the post does not exist
+func postCurrentStatus(context *AppContext, id string) (string, error) {
+	postStatus := `
+		MATCH (p:POST {id:{id}})
+		RETURN coalesce(p.status, 'published') as status
+	`
+	queryReqPostStatus := QueryRequest{
+		Name: "get-post-status",
+		Result: &[]struct {
+			Status string `json:"status"`
+		}{},
+		Query: MakeQuery(postStatus, Props{"id": id}, nil),
+	}
+
+	result := QueryResult{}
+	err := context.DB.RunSingleQuery(queryReqPostStatus, &result)
+	if err != nil {
+		return "", err
+	}
+	rows := *result.Result.(*[]struct {
+		Status string `json:"status"`
+	})
+	if len(rows) == 0 {
+		return "", nil
+	}
+	return rows[0].Status, nil
+}
+
+// Periodically publishes scheduled posts whose publish date has passed
+type PostScheduler struct {
+	db       *DB
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewPostScheduler(db *DB, interval time.Duration) *PostScheduler {
+	return &PostScheduler{
+		db:       db,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start the scheduler in its own goroutine
+func (s *PostScheduler) Start() {
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if n, err := s.PublishDue(); err != nil {
+					slog.Error("post scheduler failed", "err", err)
+				} else if n > 0 {
+					slog.Info("post scheduler published posts", "count", n)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the scheduler and wait for the running round to finish
+func (s *PostScheduler) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// Publish every scheduled post that is due, return the number published
+func (s *PostScheduler) PublishDue() (int, error) {
+	publishDue := `
+		MATCH (p:POST {status: {scheduled}})
+		WHERE p.publishDate <= timestamp()
+		SET p.status = {published}, p.lastModifiedTime = timestamp(),
+		p.version = coalesce(p.version, 0) + 1
+		RETURN count(p) as published
+	`
+	queryReqPublishDue := QueryRequest{
+		Name: "publish-due-posts",
+		Result: &[]struct {
+			Published int `json:"published"`
+		}{},
+		Query: MakeQuery(publishDue, Props{
+			"scheduled": PostStatusScheduled,
+			"published": PostStatusPublished,
+		}, nil),
+	}
+
+	result := QueryResult{}
+	err := s.db.RunSingleQuery(queryReqPublishDue, &result)
+	if err != nil {
+		return 0, err
+	}
+	rows := *result.Result.(*[]struct {
+		Published int `json:"published"`
+	})
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return rows[0].Published, nil
+}
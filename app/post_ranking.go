@@ -0,0 +1,97 @@
+// hot and trending post rankings
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	// Reddit's hot: order of magnitude of the net votes plus a bonus that
+	// grows with the publish time, so a post needs 10x the votes to beat
+	// one 12.5 hours newer. 1134028003 is the epoch Reddit uses.
+	HOT_SCORE = `
+		sign(votes) * log10(CASE WHEN abs(votes) > 1 THEN abs(votes) ELSE 1 END)
+		+ (publishTime / 1000 - 1134028003) / 45000.0
+	`
+	// Hacker News gravity: net votes decayed by age in hours
+	TRENDING_SCORE = `
+		toFloat(votes) / ((timestamp() - publishTime) / 3600000.0 + 2) ^ 1.8
+	`
+)
+
+// Length of the `window` choices in milliseconds, 0 for no limit
+var rankingWindows = map[string]int64{
+	"day":  24 * 3600 * 1000,
+	"week": 7 * 24 * 3600 * 1000,
+	"all":  0,
+}
+
+// handler for GET /posts/hot
+// Published posts by Reddit's hot score. `window` is day, week or all
+// (default), paginated with `skip` and `limit`.
+func PostGetHot(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	return postRanking(context, w, r, "hot-posts", HOT_SCORE, "all")
+}
+
+// handler for GET /posts/trending
+// Published posts by Hacker News' gravity score. `window` is day
+// (default), week or all, paginated with `skip` and `limit`.
+func PostGetTrending(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	return postRanking(context, w, r, "trending-posts", TRENDING_SCORE, "day")
+}
+
+// List published posts ordered by `score`, an expression over `votes`
+// (upvotes minus downvotes) and `publishTime`.
+func postRanking(context *AppContext, w http.ResponseWriter, r *http.Request, name string, score string, defaultWindow string) (int, error) {
+	skip, limit, err := pageParams(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = defaultWindow
+	}
+	windowLen, ok := rankingWindows[window]
+	if !ok {
+		return http.StatusBadRequest, BadRequest("window must be day, week or all")
+	}
+
+	postRank := `
+		MATCH (author:USER)-[r:CREATED]->(p:POST)
+		WHERE coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false)
+		AND NOT (author)-[:BLOCKS]->(:USER {id: {caller}})
+		WITH author, r, p, coalesce(p.publishDate, r.createTime) as publishTime,
+		coalesce(p.upvotes, 0) - coalesce(p.downvotes, 0) as votes
+		WHERE {window} = 0 OR publishTime >= timestamp() - {window}
+		WITH author, r, p, publishTime, ` + score + ` as score
+		RETURN ` + POST_COLUMNS + `, publishTime as publishDate, score
+		ORDER BY score DESC, publishTime DESC
+		SKIP {skip}
+		LIMIT {limit}
+	`
+	queryReqPostRank := QueryRequest{
+		Name:   name,
+		Result: &[]Post{},
+		Query: MakeQuery(
+			postRank,
+			Props{"window": windowLen, "skip": skip, "limit": limit, "caller": callerId(r)},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqPostRank, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	var res interface{}
+	res, err = getAuthorData(result.Result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, json.NewEncoder(w).Encode(res)
+}
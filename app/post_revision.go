@@ -0,0 +1,341 @@
+// post revision history
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Snapshot of a post's content taken before it was changed.
+// `Number` starts from 1 for each post, 0 stands for the current content.
+type Revision struct {
+	Number     int    `json:"number"`
+	Title      string `json:"title"`
+	Type       string `json:"type"`
+	Body       string `json:"body"`
+	Editor     string `json:"editor"`
+	CreateTime int    `json:"createTime"`
+}
+
+// Change of a single field between two revisions
+type FieldDiff struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// A line of a body diff. Op is " " (kept), "-" (removed) or "+" (added)
+type DiffLine struct {
+	Op   string `json:"op"`
+	Line string `json:"line"`
+}
+
+type RevisionDiff struct {
+	From   int         `json:"from"`
+	To     int         `json:"to"`
+	Fields []FieldDiff `json:"fields"`
+	Body   []DiffLine  `json:"body"`
+}
+
+// Build the query saving the current content of post `id` as a new
+// revision. Revisions are numbered from the `revisions` counter of the
+// post. The write lock of the post is taken first and held until the
+// transaction ends, so concurrent updates can't share a number nor pass
+// the version check together.
+// Nothing is created if the post does not exist, or when
+// `versions` is not nil and the post's version is not in it.
+func snapshotPostQuery(id string, editor string, versions []int) QueryRequest {
+	snapshotPost := `
+		MATCH (p:POST {id:{id}})
+		SET p._lock = true REMOVE p._lock
+		WITH p
+		WHERE {versions} IS NULL OR coalesce(p.version, 0) IN {versions}
+		SET p.revisions = coalesce(p.revisions, size((p)-[:HAS_REVISION]->())) + 1
+		CREATE (p)-[:HAS_REVISION {editor: {editor}, createTime: timestamp()}]->
+		(rev:REVISION {number: p.revisions, title: p.title, type: p.type, body: p.body})
+		RETURN rev.number as number
+	`
+	return QueryRequest{
+		Name:   "snapshot-post",
+		Result: &[]Revision{},
+		Query: MakeQuery(
+			snapshotPost,
+			Props{"id": id, "editor": editor, "versions": versions},
+			nil,
+		),
+	}
+}
+
+// Get revision `rev` of post `id`, nil if not found. `rev` may be
+// "current" for the content the post has now.
+func findPostRevision(context *AppContext, id string, rev string, caller string) (*Revision, error) {
+	var postFindRevision string
+	params := Props{"id": id, "caller": caller}
+	if rev == "current" {
+		postFindRevision = `
+			MATCH (author:USER)-[r:CREATED]->(p:POST {id:{id}})
+			WHERE (coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR author.id = {caller})
+			AND NOT (author)-[:BLOCKS]->(:USER {id: {caller}})
+			RETURN 0 as number, p.title as title, p.type as type, p.body as body,
+			author.id as editor, coalesce(p.lastModifiedTime, r.createTime) as createTime
+		`
+	} else {
+		number, err := strconv.Atoi(rev)
+		if err != nil {
+			return nil, errors.New("revision must be a number or \"current\"")
+		}
+		postFindRevision = `
+			MATCH (author:USER)-[:CREATED]->(p:POST {id:{id}})
+			-[h:HAS_REVISION]->(rev:REVISION {number:{number}})
+			WHERE (coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR author.id = {caller})
+			AND NOT (author)-[:BLOCKS]->(:USER {id: {caller}})
+			RETURN rev.number as number, rev.title as title, rev.type as type,
+			rev.body as body, h.editor as editor, h.createTime as createTime
+		`
+		params["number"] = number
+	}
+
+	queryReqFindRevision := QueryRequest{
+		Name:   "find-post-revision",
+		Result: &[]Revision{},
+		Query:  MakeQuery(postFindRevision, params, nil),
+	}
+
+	result := QueryResult{}
+	err := context.DB.RunSingleQuery(queryReqFindRevision, &result)
+	if err != nil {
+		return nil, err
+	}
+	revisions := *result.Result.(*[]Revision)
+	if len(revisions) == 0 {
+		return nil, nil
+	}
+	return &revisions[0], nil
+}
+
+// handler for GET /posts/:id/revisions
+func PostGetRevisions(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	postGetRevisions := `
+		MATCH (author:USER)-[:CREATED]->(p:POST {id:{id}})-[h:HAS_REVISION]->(rev:REVISION)
+		WHERE (coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR author.id = {caller})
+		AND NOT (author)-[:BLOCKS]->(:USER {id: {caller}})
+		RETURN rev.number as number, rev.title as title, rev.type as type,
+		rev.body as body, h.editor as editor, h.createTime as createTime
+		ORDER BY rev.number DESC
+	`
+	queryReqGetRevisions := QueryRequest{
+		Name:   "get-post-revisions",
+		Result: &[]Revision{},
+		Query: MakeQuery(
+			postGetRevisions,
+			Props{"id": ps.ByName("id"), "caller": callerId(r)},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err := context.DB.RunSingleQuery(queryReqGetRevisions, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// no revisions, tell a post never edited from a missing one
+	if len(*result.Result.(*[]Revision)) == 0 {
+		findPost := `
+			MATCH (author:USER)-[:CREATED]->(p:POST {id:{id}})
+			WHERE (coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR author.id = {caller})
+			AND NOT (author)-[:BLOCKS]->(:USER {id: {caller}})
+			RETURN p.id as id
+		`
+		found, err := anyRow(context, "find-visible-post", findPost, Props{"id": ps.ByName("id"), "caller": callerId(r)})
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if !found {
+			return http.StatusNotFound, NotFound("post")
+		}
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
+}
+
+// handler for GET /posts/:id/revisions/:rev
+func PostGetRevision(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	if _, err := strconv.Atoi(ps.ByName("rev")); err != nil {
+		return http.StatusBadRequest, BadRequest("revision must be a number")
+	}
+	rev, err := findPostRevision(context, ps.ByName("id"), ps.ByName("rev"), callerId(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if rev == nil {
+		return http.StatusNotFound, NotFound("revision")
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(rev)
+}
+
+// handler for GET /posts/:id/revisions/:rev/diff/:other
+// Either revision may be "current" to compare against the post as it is.
+func PostDiffRevisions(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	var revs [2]*Revision
+	for i, name := range []string{"rev", "other"} {
+		if _, err := strconv.Atoi(ps.ByName(name)); err != nil && ps.ByName(name) != "current" {
+			return http.StatusBadRequest, BadRequest("revision must be a number or \"current\"")
+		}
+		rev, err := findPostRevision(context, ps.ByName("id"), ps.ByName(name), callerId(r))
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if rev == nil {
+			return http.StatusNotFound, NotFound("revision")
+		}
+		revs[i] = rev
+	}
+
+	diff, err := diffRevisions(revs[0], revs[1])
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	return http.StatusOK, json.NewEncoder(w).Encode(diff)
+}
+
+// handler for POST /posts/:id/revisions/:rev/restore
+// The current content is saved as a new revision before being replaced.
+func PostRestoreRevision(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	number, err := strconv.Atoi(ps.ByName("rev"))
+	if err != nil {
+		return http.StatusBadRequest, BadRequest("revision must be a number")
+	}
+	id := ps.ByName("id")
+	rev, err := findPostRevision(context, id, ps.ByName("rev"), callerId(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if rev == nil {
+		return http.StatusNotFound, NotFound("revision")
+	}
+
+	postRestore := `
+		MATCH (author:USER)-[r:CREATED]->(p:POST {id:{id}})
+		-[:HAS_REVISION]->(rev:REVISION {number:{number}})
+		SET p.title = rev.title, p.type = rev.type, p.body = rev.body,
+		p.lastModifiedTime = timestamp(), p.version = coalesce(p.version, 0) + 1
+		RETURN ` + POST_COLUMNS + `, p.publishDate as publishDate
+	`
+	queryReqPostRestore := QueryRequest{
+		Name:   "restore-post-revision",
+		Result: &[]Post{},
+		Query:  MakeQuery(postRestore, Props{"id": id, "number": number}, nil),
+	}
+
+	results, err := context.DB.RunTransaction([]QueryRequest{
+		snapshotPostQuery(id, callerId(r), nil),
+		queryReqPostRestore,
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if posts := *results[1].Result.(*[]Post); len(posts) == 1 {
+		setETag(w, posts[0].Version)
+	}
+
+	var res interface{}
+	res, err = getAuthorData(results[1].Result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, json.NewEncoder(w).Encode(res)
+}
+
+// Largest LCS table of a diff, the product of the line counts of the two
+// bodies once their common beginning and end are set aside
+const maxDiffCells = 1 << 20
+
+// Compare the content of two revisions
+func diffRevisions(from *Revision, to *Revision) (RevisionDiff, error) {
+	body, err := diffLines(strings.Split(from.Body, "\n"), strings.Split(to.Body, "\n"))
+	if err != nil {
+		return RevisionDiff{}, err
+	}
+	diff := RevisionDiff{
+		From:   from.Number,
+		To:     to.Number,
+		Fields: []FieldDiff{},
+		Body:   body,
+	}
+	if from.Title != to.Title {
+		diff.Fields = append(diff.Fields, FieldDiff{"title", from.Title, to.Title})
+	}
+	if from.Type != to.Type {
+		diff.Fields = append(diff.Fields, FieldDiff{"type", from.Type, to.Type})
+	}
+	if from.Body != to.Body {
+		diff.Fields = append(diff.Fields, FieldDiff{"body", from.Body, to.Body})
+	}
+	return diff, nil
+}
+
+// Line based diff using the longest common subsequence of a and b
+func diffLines(a []string, b []string) ([]DiffLine, error) {
+	// lines both begin or end with are kept, only the middle is compared
+	var head, tail []DiffLine
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		head = append(head, DiffLine{" ", a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		tail = append([]DiffLine{{" ", a[len(a)-1]}}, tail...)
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	if len(a)*len(b) > maxDiffCells {
+		return nil, fmt.Errorf("revisions differ in %d and %d lines, too many to diff", len(a), len(b))
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := append([]DiffLine{}, head...)
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, DiffLine{" ", a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, DiffLine{"-", a[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{"+", b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, DiffLine{"-", a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, DiffLine{"+", b[j]})
+	}
+	return append(lines, tail...), nil
+}
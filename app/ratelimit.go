@@ -0,0 +1,245 @@
+// rate limiting
+// Each policy gives the routes it covers a token bucket per client: the
+// bucket holds up to `Burst` tokens, gains `Limit` of them every `Period`
+// and a request takes one. Requests finding the bucket empty are answered
+// with 429. Clients are told apart by API key, when it's one of the
+// configured keys, or IP address, see RateLimitPolicy.Key.
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header carrying the API key of a client
+const APIKeyHeader = "X-API-Key"
+
+// Values of `RateLimitPolicy.Key`
+var rateLimitKeys = []string{"auto", "ip"}
+
+// Where the buckets are kept. The in-memory store only limits a single
+// process, replicas behind a load balancer need a shared one.
+type RateLimitStore interface {
+	// Take a token from bucket `key`, holding up to `burst` tokens and
+	// gaining `rate` of them a second, created full if missing. Returns
+	// whether there was one and the tokens left.
+	Take(ctx context.Context, key string, rate float64, burst int) (bool, float64, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+// Refill the bucket for the time passed since its last take
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Buckets looked at to pick one to evict, see evict
+const evictionSample = 16
+
+// Keeps up to `max` buckets. When full, a new client takes the bucket of
+// another one, see evict.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	max       int
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimitStore(max int) *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*bucket{}, max: max, lastSweep: time.Now()}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, rate float64, burst int) (bool, float64, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// full buckets are the same as missing ones, drop them now and then
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if b.refill(now); b.tokens >= b.burst {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= s.max {
+			s.evict(now)
+		}
+		b = &bucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	b.rate, b.burst = rate, float64(burst)
+	b.refill(now)
+	if b.tokens < 1 {
+		return false, b.tokens, nil
+	}
+	b.tokens--
+	return true, b.tokens, nil
+}
+
+// Drop the fullest of a sample of buckets. A full bucket is the same as a
+// missing one, so clients that spent their tokens keep their buckets and
+// can't reset them by making up new clients until theirs is evicted.
+func (s *MemoryRateLimitStore) evict(now time.Time) {
+	var fullest string
+	most := -1.0
+	n := 0
+	for k, b := range s.buckets {
+		if b.refill(now); b.tokens/b.burst > most {
+			fullest, most = k, b.tokens/b.burst
+		}
+		if n++; n == evictionSample {
+			break
+		}
+	}
+	delete(s.buckets, fullest)
+}
+
+type RateLimiter struct {
+	store RateLimitStore
+	// policies by route, Ex. "PUT /posts/:id/vote"
+	policies map[string]*RateLimitPolicy
+	// of the routes no other policy covers, nil if none
+	fallback   *RateLimitPolicy
+	trustProxy bool
+	// ids of the configured API keys, see apiKeyId
+	apiKeys map[string]bool
+}
+
+func NewRateLimiter(c RateLimitConfig, store RateLimitStore) *RateLimiter {
+	l := &RateLimiter{
+		store:      store,
+		policies:   map[string]*RateLimitPolicy{},
+		trustProxy: c.TrustProxy,
+		apiKeys:    map[string]bool{},
+	}
+	for _, key := range c.APIKeys {
+		l.apiKeys[apiKeyId(key)] = true
+	}
+	for i := range c.Policies {
+		p := &c.Policies[i]
+		for _, route := range p.Routes {
+			if route == "*" {
+				l.fallback = p
+			} else {
+				l.policies[route] = p
+			}
+		}
+	}
+	return l
+}
+
+// Check that the routes of the policies are among the registered `routes`,
+// so a typo doesn't leave a route unlimited
+func (l *RateLimiter) CheckRoutes(routes []string) error {
+	if l == nil {
+		return nil
+	}
+	for route, p := range l.policies {
+		if !contains(routes, route) {
+			return fmt.Errorf("rate limit policy %s: no route %s", p.Name, route)
+		}
+	}
+	return nil
+}
+
+// Take a token for the request `r` to `route`, Ex. "PUT /posts/:id/vote",
+// setting the RateLimit headers. Returns a 429 *Error when the client ran
+// out. A failing store lets requests through.
+func (l *RateLimiter) Limit(w http.ResponseWriter, r *http.Request, route string) (int, error) {
+	if l == nil {
+		return 0, nil
+	}
+	p, ok := l.policies[route]
+	if !ok {
+		p = l.fallback
+	}
+	if p == nil {
+		return 0, nil
+	}
+
+	rate := float64(p.Limit) / p.Period.Seconds()
+	burst := p.burst()
+	allowed, tokens, err := l.store.Take(r.Context(), p.Name+":"+l.clientKey(r, p.Key), rate, burst)
+	if err != nil {
+		Logger(r.Context()).Warn("rate limit store failed", "policy", p.Name, "err", err)
+		return 0, nil
+	}
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(int(tokens)))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds((float64(burst)-tokens)/rate)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", p.Limit, seconds(p.Period.Seconds())))
+	if allowed {
+		return 0, nil
+	}
+
+	retry := seconds((1 - tokens) / rate)
+	h.Set("Retry-After", strconv.Itoa(retry))
+	rateLimited.inc(p.Name)
+	return http.StatusTooManyRequests, newError(http.StatusTooManyRequests,
+		fmt.Sprintf("rate limit of %s exceeded, retry in %ds", p.Name, retry), nil)
+}
+
+// Whole seconds, rounded up
+func seconds(s float64) int {
+	return int(math.Ceil(s))
+}
+
+// What tells the client of `r` apart under `key`, one of rateLimitKeys.
+// Headers anyone can make up, like an unknown API key or X-User-Id, would
+// give a client a new bucket with each value, so only configured API keys
+// are trusted.
+func (l *RateLimiter) clientKey(r *http.Request, key string) string {
+	if apiKey := r.Header.Get(APIKeyHeader); apiKey != "" && key != "ip" {
+		if id := apiKeyId(apiKey); l.apiKeys[id] {
+			return "key:" + id
+		}
+	}
+	return "ip:" + l.clientIP(r)
+}
+
+// Keys are secrets, they are kept and compared by a hash
+func apiKeyId(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// The address of the client of `r`. Behind a trusted proxy it's the one
+// the proxy added last to X-Forwarded-For, the earlier ones come from the
+// client.
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	if l.trustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
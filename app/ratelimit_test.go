@@ -0,0 +1,39 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// A client making up new keys while the store is full doesn't get its
+// spent bucket, or another client's, back
+func TestMemoryRateLimitStoreFull(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryRateLimitStore(4)
+	take := func(key string) bool {
+		allowed, _, err := store.Take(ctx, key, 0.001, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return allowed
+	}
+
+	for _, key := range []string{"spent", "spent", "other", "other"} {
+		if !take(key) {
+			t.Fatalf("%s: refused before its burst was spent", key)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		take(fmt.Sprintf("new%d", i))
+	}
+
+	if len(store.buckets) > 4 {
+		t.Errorf("%d buckets kept, want at most 4", len(store.buckets))
+	}
+	for _, key := range []string{"spent", "other"} {
+		if take(key) {
+			t.Errorf("%s: allowed after the store filled up", key)
+		}
+	}
+}
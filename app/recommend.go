@@ -0,0 +1,173 @@
+// recommendation handlers
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A user worth following. `Mutual` is the number of followed users who
+// follow them, `Via` lists a few of those.
+type UserRecommendation struct {
+	Id     string   `json:"id"`
+	Name   string   `json:"name"`
+	Mutual int      `json:"mutual"`
+	Via    []string `json:"via"`
+}
+
+type MutualConnections struct {
+	Count int           `json:"count"`
+	Users []UserSummary `json:"users"`
+}
+
+// handler for GET /users/:id/recommendations
+// Who to follow: users followed by the users `:id` follows, ranked by how
+// many of them do. Already followed, blocked and muted users are left out.
+func UserGetRecommendations(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	_, limit, err := pageParams(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	recommendUsers := `
+		MATCH (me:USER {id:{id}})-[:FOLLOWS]->(f:USER)-[:FOLLOWS]->(fof:USER)
+		WHERE NOT fof = me
+		AND NOT (me)-[:FOLLOWS]->(fof)
+		AND NOT (me)-[:BLOCKS]-(fof)
+		AND NOT (me)-[:MUTES]->(fof)
+		WITH fof, collect(DISTINCT f.id) as via
+		RETURN fof.id as id, fof.name as name, size(via) as mutual, via[0..3] as via
+		ORDER BY mutual DESC, id
+		LIMIT {limit}
+	`
+	queryReqRecommendUsers := QueryRequest{
+		Name:   "recommend-users",
+		Result: &[]UserRecommendation{},
+		Query: MakeQuery(
+			recommendUsers,
+			Props{"id": ps.ByName("id"), "limit": limit},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqRecommendUsers, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
+}
+
+// handler for GET /users/:id/mutual/:otherId
+// Users followed by both `:id` and `:otherId`
+func UserGetMutual(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	mutualConnections := `
+		MATCH (a:USER {id:{id}})-[:FOLLOWS]->(m:USER)<-[:FOLLOWS]-(b:USER {id:{otherId}})
+		RETURN m.id as id, m.name as name
+		ORDER BY name
+	`
+	queryReqMutualConnections := QueryRequest{
+		Name:   "mutual-connections",
+		Result: &[]UserSummary{},
+		Query: MakeQuery(
+			mutualConnections,
+			Props{"id": ps.ByName("id"), "otherId": ps.ByName("otherId")},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err := context.DB.RunSingleQuery(queryReqMutualConnections, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	users := *result.Result.(*[]UserSummary)
+	return http.StatusOK, json.NewEncoder(w).Encode(MutualConnections{len(users), users})
+}
+
+// A user whose votes overlap with the ones of the user recommended to.
+// `Similarity` is the Jaccard index of their voted posts.
+type SimilarUser struct {
+	Id         string  `json:"id"`
+	Name       string  `json:"name"`
+	Similarity float64 `json:"similarity"`
+}
+
+type PostRecommendation struct {
+	Id          string        `json:"id"`
+	Title       string        `json:"title"`
+	Type        string        `json:"type"`
+	Author      string        `json:"author"`
+	PublishDate int           `json:"publishDate"`
+	Upvotes     int           `json:"upvotes"`
+	Score       float64       `json:"score"`
+	Explanation []SimilarUser `json:"explanation"`
+}
+
+const (
+	// number of most similar users whose votes feed post recommendations
+	similarUserLimit = 50
+	// number of similar users listed in a recommendation's explanation
+	explanationLimit = 5
+)
+
+// handler for GET /users/:id/recommended-posts
+// Collaborative filtering over VOTED: posts voted by the users whose votes
+// overlap most with `:id`'s, scored by the sum of their similarity. Posts
+// the user wrote or already voted, and posts by blocked or muted users, are
+// left out.
+func UserGetRecommendedPosts(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	_, limit, err := pageParams(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	recommendPosts := `
+		MATCH (me:USER {id:{id}})-[:VOTED]->(p:POST)<-[:VOTED]-(other:USER)
+		WHERE other <> me AND NOT (me)-[:BLOCKS]-(other)
+		WITH me, other, count(DISTINCT p) as shared
+		WITH me, other, shared,
+		size((me)-[:VOTED]->(:POST)) as myVotes,
+		size((other)-[:VOTED]->(:POST)) as theirVotes
+		WITH me, other, toFloat(shared) / (myVotes + theirVotes - shared) as similarity
+		ORDER BY similarity DESC
+		LIMIT {similarUsers}
+		MATCH (other)-[:VOTED]->(rec:POST)<-[:CREATED]-(author:USER)
+		WHERE coalesce(rec.status, 'published') = 'published' AND NOT coalesce(rec.hidden, false)
+		AND NOT (me)-[:VOTED]->(rec)
+		AND NOT (me)-[:CREATED]->(rec)
+		AND NOT (me)-[:BLOCKS]-(author)
+		AND NOT (me)-[:MUTES]->(author)
+		WITH rec, author, other, similarity
+		ORDER BY similarity DESC
+		WITH rec, author, sum(similarity) as score,
+		collect({id: other.id, name: other.name, similarity: similarity}) as similar
+		RETURN rec.id as id, rec.title as title, rec.type as type,
+		author.id as author, rec.publishDate as publishDate,
+		rec.upvotes as upvotes, score, similar[0..{explanation}] as explanation
+		ORDER BY score DESC, publishDate DESC
+		LIMIT {limit}
+	`
+	queryReqRecommendPosts := QueryRequest{
+		Name:   "recommend-posts",
+		Result: &[]PostRecommendation{},
+		Query: MakeQuery(recommendPosts, Props{
+			"id":           ps.ByName("id"),
+			"similarUsers": similarUserLimit,
+			"explanation":  explanationLimit,
+			"limit":        limit,
+		}, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqRecommendPosts, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
+}
@@ -0,0 +1,149 @@
+// relation handlers
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// default and maximum length of the paths searched between nodes
+	defaultPathDepth = 4
+	maxPathDepth     = 10
+)
+
+// Public relationship types of the app's graph. Types can't be passed as
+// query parameters, so the ones given by clients are checked against this
+// list before going into a statement. HAS_REVISION is left out, revisions
+// keep the content of posts that were since hidden.
+var relationTypes = []string{
+	"CREATED", "VOTED", "FOLLOWS", "WROTE", "ON", "REPLY_TO", "TAGGED",
+}
+
+type PathNode struct {
+	Id     string   `json:"id"`
+	Labels []string `json:"labels"`
+}
+
+type PathRelationship struct {
+	Type  string `json:"type"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// A path between two nodes, `Nodes` runs from the first node to the last
+// and `Relationships[i]` links `Nodes[i]` and `Nodes[i+1]`
+type GraphPath struct {
+	Length        int                `json:"length"`
+	Nodes         []PathNode         `json:"nodes"`
+	Relationships []PathRelationship `json:"relationships"`
+}
+
+type PathResult struct {
+	Degrees int         `json:"degrees"`
+	Paths   []GraphPath `json:"paths"`
+}
+
+// Read the `types` query parameter (comma separated) into a relationship
+// pattern like ":FOLLOWS|CREATED". All of relationTypes when no types are
+// given, so private relationships like BLOCKS are never followed.
+func relationTypePattern(r *http.Request) (string, error) {
+	param := r.URL.Query().Get("types")
+	if param == "" {
+		return ":" + strings.Join(relationTypes, "|"), nil
+	}
+	types := strings.Split(param, ",")
+	for i, t := range types {
+		t = strings.ToUpper(strings.TrimSpace(t))
+		known := false
+		for _, rt := range relationTypes {
+			if t == rt {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return "", fmt.Errorf("unknown relationship type %q", t)
+		}
+		types[i] = t
+	}
+	return ":" + strings.Join(types, "|"), nil
+}
+
+// handler for GET /relation/:id1/:id2/path
+// Shortest path between two nodes by id. `maxDepth` bounds the path
+// length, `types` restricts the relationship types and `all=true` returns
+// every shortest path instead of one.
+func RelationGetPath(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	if ps.ByName("id1") == ps.ByName("id2") {
+		return http.StatusBadRequest, BadRequest("ids must be different")
+	}
+	depth := defaultPathDepth
+	if d := r.URL.Query().Get("maxDepth"); d != "" {
+		var err error
+		depth, err = strconv.Atoi(d)
+		if err != nil || depth < 1 || depth > maxPathDepth {
+			return http.StatusBadRequest, BadRequest(fmt.Sprintf("maxDepth must be between 1 and %d", maxPathDepth))
+		}
+	}
+	types, err := relationTypePattern(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	shortest := "shortestPath"
+	if r.URL.Query().Get("all") == "true" {
+		shortest = "allShortestPaths"
+	}
+
+	// paths don't go through unpublished or hidden posts, nor end at one
+	relationGetPath := `
+		MATCH (a {id:{id1}}), (b {id:{id2}})
+		MATCH path = ` + shortest + `((a)-[` + types + `*..` + strconv.Itoa(depth) + `]-(b))
+		WHERE ALL(x IN nodes(path) WHERE
+			NOT x:POST OR coalesce(x.status, 'published') = 'published' AND NOT coalesce(x.hidden, false))
+		RETURN length(path) as length,
+		extract(n IN nodes(path) | {id: n.id, labels: labels(n)}) as nodes,
+		extract(rel IN relationships(path) |
+			{type: type(rel), start: startNode(rel).id, end: endNode(rel).id}) as relationships
+	`
+	queryReqRelationGetPath := QueryRequest{
+		Name:   "relation-get-path",
+		Result: &[]GraphPath{},
+		Query: MakeQuery(
+			relationGetPath,
+			Props{"id1": ps.ByName("id1"), "id2": ps.ByName("id2")},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqRelationGetPath, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	paths := *result.Result.(*[]GraphPath)
+	if len(paths) == 0 {
+		return http.StatusNotFound, NotFound("path within max depth")
+	}
+	// neo4j returns paths of the same length in no particular order
+	sort.Slice(paths, func(i, j int) bool {
+		return pathKey(paths[i]) < pathKey(paths[j])
+	})
+
+	return http.StatusOK, json.NewEncoder(w).Encode(PathResult{paths[0].Length, paths})
+}
+
+// Key sorting paths by the ids of their nodes
+func pathKey(path GraphPath) string {
+	ids := make([]string, len(path.Nodes))
+	for i, n := range path.Nodes {
+		ids[i] = n.Id
+	}
+	return strings.Join(ids, "\x00")
+}
@@ -0,0 +1,339 @@
+// request bodies and their validation
+// Request structs declare their rules in a `validate` tag, Ex.
+// `validate:"required,max=100"`. The rules are `required` (not empty),
+// `min=N` and `max=N` (characters of a string, elements of a list),
+// `email`, and `oneof=a|b` (one of the values, when given).
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Largest request body accepted, larger ones are answered with 413
+var MaxBodyBytes int64 = 1 << 20
+
+// Body of user create and update. Users start with role `user`, which
+// isn't set through the API.
+type UserRequest struct {
+	Id             string `json:"id" validate:"max=64"`
+	Name           string `json:"name" validate:"required,max=100"`
+	Email          string `json:"email" validate:"required,email,max=254"`
+	HashedPassword string `json:"hashedPassword" validate:"max=256"`
+	Salt           string `json:"salt" validate:"max=256"`
+}
+
+// The node properties of the user, empty fields left out
+func (u *UserRequest) props() Props {
+	return nonEmpty(Props{
+		"name":           u.Name,
+		"email":          u.Email,
+		"hashedPassword": u.HashedPassword,
+		"salt":           u.Salt,
+	})
+}
+
+// Body of post create and update. Status and publish date are only taken
+// on create, afterwards they change through the lifecycle endpoints.
+type PostRequest struct {
+	Id          string   `json:"id" validate:"max=64"`
+	Author      string   `json:"author" validate:"required,max=64"`
+	Title       string   `json:"title" validate:"required,max=300"`
+	Type        string   `json:"type" validate:"required,oneof=text|link|image|video"`
+	Body        string   `json:"body" validate:"max=100000"`
+	Status      string   `json:"status" validate:"oneof=draft|scheduled|published"`
+	PublishDate *int64   `json:"publishDate"`
+	Tags        []string `json:"tags" validate:"max=20"`
+}
+
+// The node properties of the post, empty fields left out
+func (p *PostRequest) props() Props {
+	return nonEmpty(Props{
+		"title": p.Title,
+		"type":  p.Type,
+		"body":  p.Body,
+	})
+}
+
+// Body of post vote and unvote
+type VoteRequest struct {
+	Id string `json:"id" validate:"required,max=64"`
+}
+
+// Body of post publish, optional
+type PublishRequest struct {
+	PublishDate *int64 `json:"publishDate"`
+}
+
+// Body of comment create, `parent` is only given for replies
+type CommentRequest struct {
+	Author string `json:"author" validate:"required,max=64"`
+	Body   string `json:"body" validate:"required,max=10000"`
+	Parent string `json:"parent" validate:"max=64"`
+}
+
+// Body of comment update
+type CommentUpdateRequest struct {
+	Body string `json:"body" validate:"required,max=10000"`
+}
+
+// Body of comment vote
+type CommentVoteRequest struct {
+	Id   string `json:"id" validate:"required,max=64"`
+	Down bool   `json:"down"`
+}
+
+// Body of post save, optional
+type SaveRequest struct {
+	Collection string `json:"collection" validate:"max=100"`
+}
+
+// Body of follow, block and mute, and of undoing them. `id` is the
+// acting user.
+type UserIdRequest struct {
+	Id string `json:"id" validate:"required,max=64"`
+}
+
+// Body of post and user report, `reason` is one of ReportReasons
+type ReportRequest struct {
+	Id     string `json:"id" validate:"required,max=64"`
+	Reason string `json:"reason" validate:"required"`
+	Note   string `json:"note" validate:"max=1000"`
+}
+
+// Body of report resolution
+type ResolveRequest struct {
+	Status string `json:"status" validate:"required,oneof=actioned|dismissed"`
+	Action string `json:"action" validate:"oneof=hide_post|suspend_user"`
+	Note   string `json:"note" validate:"max=1000"`
+}
+
+// Body of moderation actions, optional
+type NoteRequest struct {
+	Note string `json:"note" validate:"max=1000"`
+}
+
+func nonEmpty(props Props) Props {
+	for k, v := range props {
+		if v == "" {
+			delete(props, k)
+		}
+	}
+	return props
+}
+
+// Read the JSON body of `r` into the struct `v` and validate it. Bodies
+// over MaxBodyBytes, malformed JSON, unknown fields and fields breaking
+// their rules are answered with an *Error.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return bodyError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return Validation("body must hold a single JSON object")
+	}
+	if fields := validateStruct(v); len(fields) > 0 {
+		return Validation("invalid request body", fields...)
+	}
+	return nil
+}
+
+// Same as decodeBody for routes where the body is optional, an empty
+// body leaves `v` as it is
+func decodeOptionalBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	b, err := readBody(w, r)
+	if err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(string(b))) == 0 {
+		return nil
+	}
+	r.Body = io.NopCloser(strings.NewReader(string(b)))
+	return decodeBody(w, r, v)
+}
+
+// Read the JSON Merge Patch body of `r`. Each field it sets must be a
+// field of the request struct `v` points to, Ex. &UserRequest{}, and
+// follow its rules. Fields set to null are removed, unless required.
+// `readOnly` fields are rejected.
+func decodePatch(w http.ResponseWriter, r *http.Request, v interface{}, readOnly ...string) (map[string]interface{}, error) {
+	b, err := readBody(w, r)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, bodyError(err)
+	}
+	if raw == nil {
+		return nil, Validation("patch must be a JSON object")
+	}
+
+	var fields []FieldError
+	props := map[string]interface{}{}
+	for name, value := range raw {
+		field, ok := jsonField(reflect.TypeOf(v).Elem(), name)
+		switch {
+		case contains(readOnly, name):
+			fields = append(fields, FieldError{name, "is read-only"})
+			continue
+		case !ok:
+			fields = append(fields, FieldError{name, "unknown field"})
+			continue
+		}
+		tag := field.Tag.Get("validate")
+		if string(value) == "null" {
+			if contains(strings.Split(tag, ","), "required") {
+				fields = append(fields, FieldError{name, "is required"})
+			}
+			props[name] = nil
+			continue
+		}
+		f := reflect.New(field.Type)
+		if err := json.Unmarshal(value, f.Interface()); err != nil {
+			fields = append(fields, FieldError{name, "must be " + jsonKind(field.Type)})
+			continue
+		}
+		if msg := validateField(f.Elem(), tag); msg != "" {
+			fields = append(fields, FieldError{name, msg})
+			continue
+		}
+		var prop interface{}
+		json.Unmarshal(value, &prop)
+		props[name] = prop
+	}
+	if len(fields) > 0 {
+		sort.Slice(fields, func(i, j int) bool { return fields[i].Field < fields[j].Field })
+		return nil, Validation("invalid request body", fields...)
+	}
+	return props, nil
+}
+
+// The field of struct type `t` named `name` in JSON
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] == name {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// Read the whole body of `r`, at most MaxBodyBytes
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodyBytes))
+	if err != nil {
+		return nil, bodyError(err)
+	}
+	return b, nil
+}
+
+// Turn an error reading or decoding a body into an *Error
+func bodyError(err error) *Error {
+	var tooLarge *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &tooLarge):
+		return newError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("body larger than %d bytes", tooLarge.Limit), err)
+	case err == io.EOF:
+		return Validation("request body required")
+	case errors.As(err, &syntaxErr), err == io.ErrUnexpectedEOF:
+		return Validation("malformed JSON: " + err.Error())
+	case errors.As(err, &typeErr):
+		return Validation("invalid request body", FieldError{typeErr.Field, "must be " + jsonKind(typeErr.Type)})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return Validation("invalid request body", FieldError{field, "unknown field"})
+	}
+	return Validation(err.Error())
+}
+
+// How a Go type looks in JSON, for error messages
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice:
+		return "a list"
+	}
+	return "an object"
+}
+
+// Check the fields of the struct `v` points to against their `validate` tags
+func validateStruct(v interface{}) []FieldError {
+	var fields []FieldError
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		tag := rt.Field(i).Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		name := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+		if msg := validateField(rv.Field(i), tag); msg != "" {
+			fields = append(fields, FieldError{name, msg})
+		}
+	}
+	return fields
+}
+
+// Apply the rules of `tag` to `f`, the message of the first one broken
+func validateField(f reflect.Value, tag string) string {
+	var size int
+	var str string
+	switch f.Kind() {
+	case reflect.String:
+		str = f.String()
+		size = utf8.RuneCountInString(str)
+	case reflect.Slice:
+		size = f.Len()
+	}
+	empty := f.IsZero()
+
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+		switch name {
+		case "required":
+			if empty {
+				return "is required"
+			}
+		case "min":
+			if n, _ := strconv.Atoi(arg); !empty && size < n {
+				return "must have at least " + arg + " characters or elements"
+			}
+		case "max":
+			if n, _ := strconv.Atoi(arg); size > n {
+				return "must have at most " + arg + " characters or elements"
+			}
+		case "email":
+			if addr, err := mail.ParseAddress(str); !empty && (err != nil || addr.Address != str) {
+				return "must be an email address"
+			}
+		case "oneof":
+			if !empty && !contains(strings.Split(arg, "|"), str) {
+				return "must be one of " + strings.Replace(arg, "|", ", ", -1)
+			}
+		}
+	}
+	return ""
+}
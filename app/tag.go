@@ -0,0 +1,213 @@
+// tag handlers
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Max number of tags on a post
+const maxPostTags = 20
+
+var (
+	// Replace the tags of post `p` with {tags} unless it's null. Goes right
+	// before the post projection, `author`, `r` and `p` must be bound.
+	SET_POST_TAGS = `
+		WITH author, r, p
+		OPTIONAL MATCH (p)-[old:TAGGED]->(:TAG)
+		WHERE {tags} IS NOT NULL
+		DELETE old
+		WITH DISTINCT author, r, p
+		FOREACH (tag IN coalesce({tags}, []) |
+			MERGE (t:TAG {slug: tag.slug})
+			ON CREATE SET t.name = tag.name
+			MERGE (p)-[:TAGGED]->(t))
+	`
+	// Columns of a Post read from `p`, its CREATED relationship `r` and
+	// `author`, of whom only the id and name are shown. Queries follow it
+	// with their own publishDate column.
+	POST_COLUMNS = `p.id as id, p.title as title, p.type as type,
+		p.body as body, p.status as status,
+		p.upvotes as upvotes, p.downvotes as downvotes,
+		p.viewCount as viewCount, r.createTime as createTime,
+		size(filter(path IN (p)<-[:ON]-(:COMMENT)
+			WHERE NOT coalesce(last(nodes(path)).deleted, false))) as commentCount,
+		extract(path IN (p)-[:TAGGED]->(:TAG) | last(nodes(path)).slug) as tags,
+		p.lastModifiedTime as lastModifiedTime,
+		{id: author.id, name: author.name} as author,
+		coalesce(p.version, 0) as version`
+)
+
+type Tag struct {
+	Slug  string `json:"slug"`
+	Name  string `json:"name"`
+	Posts int    `json:"posts"`
+}
+
+// Normalize a tag name to its slug: lowercase letters and digits, words
+// joined by "-". Ex. "Graph Databases!" -> "graph-databases"
+func tagSlug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(name) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(c)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// Take the `tags` field out of post props, ready for SET_POST_TAGS.
+// Returns nil if the field is absent, an empty list if it is null.
+func parsePostTags(props map[string]interface{}) ([]Props, error) {
+	v, ok := props["tags"]
+	delete(props, "tags")
+	if !ok {
+		return nil, nil
+	}
+	if v == nil {
+		return []Props{}, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("tags must be a list of strings")
+	}
+	names := make([]string, len(list))
+	for i, n := range list {
+		if names[i], ok = n.(string); !ok {
+			return nil, errors.New("tags must be a list of strings")
+		}
+	}
+	return postTags(names)
+}
+
+// Normalize tag names for SET_POST_TAGS, dropping duplicates
+func postTags(names []string) ([]Props, error) {
+	tags := []Props{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		slug := tagSlug(name)
+		if slug == "" || seen[slug] {
+			continue
+		}
+		seen[slug] = true
+		tags = append(tags, Props{"slug": slug, "name": strings.TrimSpace(name)})
+	}
+	if len(tags) > maxPostTags {
+		return nil, errors.New("too many tags")
+	}
+	return tags, nil
+}
+
+// handler for GET /tags
+// Tags with the number of published posts carrying them
+func TagGetAll(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	tagGetAll := `
+		MATCH (t:TAG)
+		OPTIONAL MATCH (t)<-[:TAGGED]-(p:POST)
+		WHERE coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false)
+		RETURN t.slug as slug, t.name as name, count(p) as posts
+		ORDER BY posts DESC, slug
+	`
+	queryReqTagGetAll := QueryRequest{
+		Name:   "tag-get-all",
+		Result: &[]Tag{},
+		Query:  MakeQuery(tagGetAll, nil, nil),
+	}
+
+	result := QueryResult{}
+	err := context.DB.RunSingleQuery(queryReqTagGetAll, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
+}
+
+// handler for GET /tags/:slug/posts
+// Newest posts first, paginated with `skip` and `limit`
+func TagGetPosts(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	skip, limit, err := pageParams(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	tagGetPosts := `
+		MATCH (author:USER)-[r:CREATED]->(p:POST)-[:TAGGED]->(:TAG {slug:{slug}})
+		WHERE (coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false) OR author.id = {caller})
+		AND NOT (author)-[:BLOCKS]->(:USER {id: {caller}})
+		RETURN ` + POST_COLUMNS + `, p.publishDate as publishDate
+		ORDER BY coalesce(p.publishDate, r.createTime) DESC
+		SKIP {skip}
+		LIMIT {limit}
+	`
+	queryReqTagGetPosts := QueryRequest{
+		Name:   "tag-get-posts",
+		Result: &[]Post{},
+		Query: MakeQuery(tagGetPosts, Props{
+			"slug":   tagSlug(ps.ByName("slug")),
+			"caller": callerId(r),
+			"skip":   skip,
+			"limit":  limit,
+		}, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqTagGetPosts, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	var res interface{}
+	res, err = getAuthorData(result.Result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, json.NewEncoder(w).Encode(res)
+}
+
+// handler for GET /tags/:slug/related
+// Tags that most often appear on the same published posts as `slug`.
+// `posts` is the number of posts the two tags share.
+func TagGetRelated(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	_, limit, err := pageParams(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	tagGetRelated := `
+		MATCH (t:TAG {slug:{slug}})<-[:TAGGED]-(p:POST)-[:TAGGED]->(other:TAG)
+		WHERE coalesce(p.status, 'published') = 'published' AND NOT coalesce(p.hidden, false)
+		RETURN other.slug as slug, other.name as name, count(p) as posts
+		ORDER BY posts DESC, slug
+		LIMIT {limit}
+	`
+	queryReqTagGetRelated := QueryRequest{
+		Name:   "tag-get-related",
+		Result: &[]Tag{},
+		Query: MakeQuery(
+			tagGetRelated,
+			Props{"slug": tagSlug(ps.ByName("slug")), "limit": limit},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqTagGetRelated, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
+}
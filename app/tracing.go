@@ -0,0 +1,119 @@
+// OpenTelemetry tracing
+// Every request gets a server span, continuing the trace of a W3C
+// `traceparent` header when there is one, and every Cypher query a client
+// span under it.
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "wok-go-neo4j"
+
+var tracer = otel.Tracer("github.com/leozhucong/wok-go-neo4j/app")
+
+// Values of `TracingConfig.Exporter`
+var tracingExporters = []string{"none", "stdout", "otlp"}
+
+// Install the tracer provider exporting spans as configured. The returned
+// function flushes the spans not exported yet, call it on shutdown.
+func SetupTracing(ctx context.Context, c TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.Endpoint)}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		err = errors.New("unknown exporter " + c.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName),
+			attribute.String("service.version", BuildVersion),
+		)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start the server span of `r`, matched by `route`. The returned request
+// carries the span in its context.
+func StartRequestSpan(r *http.Request, route string) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("request.id", RequestID(ctx)),
+		),
+	)
+	return r.WithContext(ctx), span
+}
+
+// End the server span of a request answered with `status`
+func EndRequestSpan(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, strconv.Itoa(status))
+	}
+	span.End()
+}
+
+// Start the client span of Cypher query `name` under the request `ctx`
+func startQuerySpan(ctx context.Context, name string) trace.Span {
+	_, span := tracer.Start(ctx, "cypher "+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "neo4j"),
+			attribute.String("db.operation.name", name),
+		),
+	)
+	return span
+}
+
+// End the span of a query with its row count, `result` is the pointer to
+// the slice the rows were read into
+func endQuerySpan(span trace.Span, result interface{}, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if v := reflect.ValueOf(result); v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Slice {
+		span.SetAttributes(attribute.Int("db.response.returned_rows", v.Elem().Len()))
+	}
+	span.End()
+}
@@ -3,31 +3,28 @@ package app
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 var (
+	// listings show who users are, not their emails or roles
 	ALL_USER = `
 		MATCH (u:USER)
-		RETURN u.name as name, u.email as email, u.role as role,
-				u.hashedPassword as hashedPassword, u.salt as salt,
-				u.id as id
+		RETURN u.id as id, u.name as name
 	`
 	FIND_USER_BY_EMAIL = `
 		MATCH (u:USER)
 		WHERE u.email={email}
 		RETURN u.name as name, u.email as email, u.role as role,
-				u.hashedPassword as hashedPassword, u.salt as salt,
 				u.id as id
 	`
 	FIND_USER_BY_ID = `
 		MATCH (u:USER)
 		WHERE u.id={id}
 		RETURN u.name as name, u.email as email, u.role as role,
-				u.hashedPassword as hashedPassword, u.salt as salt,
 				u.id as id
 	
 	`
@@ -47,21 +44,22 @@ type Person struct {
 	Born int    `json:"born"`
 }
 
-// for storing User
+// for storing User. Password hashes and salts are never read back.
 type User struct {
-	Id             string `json:"id"`
-	Name           string `json:"name"`
-	Email          string `json:"email"`
-	Role           string `json:"role"`
-	HashedPassword string `json:"hashedPassword"`
-	Salt           string `json:"salt"`
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	Version   int    `json:"version"`
+	Followers int    `json:"followers"`
+	Following int    `json:"following"`
 }
 
 // handler for GET `/users`
 func UserGetAll(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
 	queryReqFindAllUser := QueryRequest{
 		Name:   "find-all-user",
-		Result: &[]User{},
+		Result: &[]UserSummary{},
 		Query: MakeQuery(
 			ALL_USER,
 			nil,
@@ -83,8 +81,9 @@ func UserGetOne(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 	userFindById := `
 		MATCH (u:USER {id:{id}})
 		RETURN u.name as name, u.email as email, u.role as role,
-				u.hashedPassword as hashedPassword, u.salt as salt,
-				u.id as id
+				u.id as id, coalesce(u.version, 0) as version,
+				size((u)<-[:FOLLOWS]-(:USER)) as followers,
+				size((u)-[:FOLLOWS]->(:USER)) as following
 	`
 
 	queryReqFindUserById := QueryRequest{
@@ -98,27 +97,28 @@ func UserGetOne(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	users := *result.Result.(*[]User)
+	if len(users) == 0 {
+		return http.StatusNotFound, NotFound("user")
+	}
+	setETag(w, users[0].Version)
 
 	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
 }
 
 // handler for POST `/users/query`
 func UserQuery(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
-	body, err := getReqBody(r)
+	body, err := getReqBody(w, r)
 	if err != nil {
 		return http.StatusBadRequest, err
 	}
 
-	log.Println("query body: " + body)
-
 	finUserCQ := "MATCH (u:USER " + body + ")" +
-		"RETURN u.name as name, u.email as email, u.role as role," +
-		"u.hashedPassword as hashedPassword, u.salt as salt," +
-		"u.id as id"
+		"RETURN u.id as id, u.name as name"
 
 	queryReqFindUser := QueryRequest{
 		Name:   "find-user",
-		Result: &[]User{},
+		Result: &[]UserSummary{},
 		Query: MakeQuery(
 			finUserCQ,
 			nil,
@@ -136,26 +136,43 @@ func UserQuery(context *AppContext, w http.ResponseWriter, r *http.Request, ps h
 }
 
 // handler for POST `/users`
-// Create a user, need to check duplications
+// Create a user, the id and email must not be taken. An id is generated
+// when none is given.
 func UserCreate(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
-	body, err := getReqBody(r)
+	var body UserRequest
+	err := decodeBody(w, r, &body)
 	if err != nil {
 		return http.StatusBadRequest, err
 	}
-	log.Println(body)
+	if body.Id == "" {
+		body.Id = newId()
+	}
 
-	createUserCQ := "CREATE (u:USER " + body + ")" +
-		"RETURN u.name as name, u.email as email, u.role as role," +
-		"u.hashedPassword as hashedPassword, u.salt as salt," +
-		"u.id as id"
+	findDuplicate := `
+		MATCH (u:USER)
+		WHERE u.id = {id} OR u.email = {email}
+		RETURN u.id as id
+	`
+	taken, err := anyRow(context, "find-duplicate-user", findDuplicate, Props{"id": body.Id, "email": body.Email})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if taken {
+		return http.StatusConflict, Conflict("a user with this id or email already exists")
+	}
 
-	log.Println(createUserCQ)
+	createUserCQ := `
+		CREATE (u:USER {props})
+		SET u.id = {id}, u.role = 'user', u.version = 1
+		RETURN u.name as name, u.email as email, u.role as role,
+		u.id as id, u.version as version
+	`
 	queryReqCreateUser := QueryRequest{
 		Name:   "create-user",
 		Result: &[]User{},
 		Query: MakeQuery(
 			createUserCQ,
-			nil,
+			Props{"id": body.Id, "props": body.props()},
 			nil,
 		),
 	}
@@ -172,24 +189,47 @@ func UserCreate(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 // handler for PUT `/users/:id`
 // This will update the user or create one if not exists
 func UserUpdate(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
-	var props map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&props)
+	var body UserRequest
+	err := decodeBody(w, r, &body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if body.Id != "" && body.Id != ps.ByName("id") {
+		return http.StatusBadRequest, Validation("invalid request body", FieldError{"id", "must match the id in the path"})
+	}
 
-	log.Printf("query map: %v\n", props)
+	findDuplicate := `
+		MATCH (u:USER)
+		WHERE u.email = {email} AND u.id <> {id}
+		RETURN u.id as id
+	`
+	taken, err := anyRow(context, "find-duplicate-user", findDuplicate, Props{"id": ps.ByName("id"), "email": body.Email})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if taken {
+		return http.StatusConflict, Conflict("a user with this email already exists")
+	}
 
+	// credentials left out of the body are kept
 	saveUserCQ := `
 		MERGE (u:USER {id: {id}})
-		ON CREATE SET u = {props}
-		ON MATCH SET u = {props}
+		WITH u, coalesce(u.version, 0) as version, coalesce(u.role, 'user') as role,
+		u.suspended as suspended, u.hashedPassword as hashedPassword, u.salt as salt
+		SET u = {props}, u.id = {id}, u.version = version + 1,
+		u.role = role, u.suspended = suspended,
+		u.hashedPassword = coalesce({props}.hashedPassword, hashedPassword),
+		u.salt = coalesce({props}.salt, salt)
 		RETURN u.name as name, u.email as email, u.role as role,
-		u.hashedPassword as hashedPassword, u.salt as salt, u.id as id
+		u.id as id,
+		u.version as version
 	`
 	queryReqUpdateUser := QueryRequest{
 		Name:   "update-user",
 		Result: &[]User{},
 		Query: MakeQuery(
 			saveUserCQ,
-			Props{"id": ps.ByName("id"), "props": props},
+			Props{"id": ps.ByName("id"), "props": body.props()},
 			nil,
 		),
 	}
@@ -199,6 +239,55 @@ func UserUpdate(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	if users := *result.Result.(*[]User); len(users) == 1 {
+		setETag(w, users[0].Version)
+	}
+
+	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
+}
+
+// handler for PATCH `/users/:id`
+// Apply a JSON Merge Patch to the user, properties set to null are
+// removed and the ones left out are kept. Send the ETag in `If-Match` to
+// refuse the patch when someone else changed the user meanwhile.
+func UserPatch(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
+	props, err := decodePatch(w, r, &UserRequest{}, "id", "version", "role", "suspended", "hashedPassword", "salt")
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// take the write lock before reading the version, so a concurrent
+	// patch with the same ETag waits for it and then fails the check
+	patchUser := `
+		MATCH (u:USER {id: {id}})
+		SET u._lock = true REMOVE u._lock
+		WITH u
+		WHERE {versions} IS NULL OR coalesce(u.version, 0) IN {versions}
+		SET u += {props}, u.version = coalesce(u.version, 0) + 1
+		RETURN u.name as name, u.email as email, u.role as role,
+		u.id as id,
+		u.version as version
+	`
+	queryReqPatchUser := QueryRequest{
+		Name:   "patch-user",
+		Result: &[]User{},
+		Query: MakeQuery(
+			patchUser,
+			Props{"id": ps.ByName("id"), "props": props, "versions": parseIfMatch(r)},
+			nil,
+		),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqPatchUser, &result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	users := *result.Result.(*[]User)
+	if len(users) == 0 {
+		return preconditionStatus(context, "USER", ps.ByName("id"))
+	}
+	setETag(w, users[0].Version)
 
 	return http.StatusOK, json.NewEncoder(w).Encode(result.Result)
 }
@@ -206,9 +295,7 @@ func UserUpdate(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 // TODO Not implemented yet!!
 // handler for POST /users/query/:queryName
 func UserComplexQuery(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
-	queryName := ps.ByName("queryName")
-	log.Println(queryName)
-	return http.StatusNotImplemented, json.NewEncoder(w).Encode("Not implemented yet")
+	return http.StatusNotImplemented, errors.New("not implemented yet")
 }
 
 // TODO Maybe soft-delete is better?
@@ -217,12 +304,16 @@ func UserComplexQuery(context *AppContext, w http.ResponseWriter, r *http.Reques
 func UserDestroy(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
 	userDestroy := `
 		MATCH (u:USER {id:{id}})
+		WITH u, u.id as id
 		DETACH DELETE u
+		RETURN id
 	`
 	queryReqUserDestroy := QueryRequest{
-		Name:   "delelte-user",
-		Result: nil,
-		Query:  MakeQuery(userDestroy, Props{"id": ps.ByName("id")}, nil),
+		Name: "delelte-user",
+		Result: &[]struct {
+			Id string `json:"id"`
+		}{},
+		Query: MakeQuery(userDestroy, Props{"id": ps.ByName("id")}, nil),
 	}
 
 	result := QueryResult{}
@@ -230,8 +321,13 @@ func UserDestroy(context *AppContext, w http.ResponseWriter, r *http.Request, ps
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	if len(*result.Result.(*[]struct {
+		Id string `json:"id"`
+	})) == 0 {
+		return http.StatusNotFound, NotFound("user")
+	}
 
-	return http.StatusOK, json.NewEncoder(w).Encode("Delete user ok.")
+	return noContent(w)
 }
 
 func UserGetVotedPosts(context *AppContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int, error) {
@@ -2,10 +2,14 @@
 package app
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"io"
+	"fmt"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 // Format {"name": "Jon Snow"} to {name: "Jon Snow"}
@@ -13,14 +17,54 @@ func formatToNeoJson(jsonString string) string {
 	return regexp.MustCompile(`"([a-zA-Z0-9]+)":`).ReplaceAllString(jsonString, "${1}:")
 }
 
+// Get the id of the user making the request.
+// Note: there is no authentication yet, clients identify themselves with
+// the `X-User-Id` header. It must be set by a trusted gateway that
+// authenticates the caller and drops the client's own. Empty for
+// anonymous requests.
+func callerId(r *http.Request) string {
+	return r.Header.Get("X-User-Id")
+}
+
+const (
+	// page size used when `limit` is not given, and the largest allowed
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// Read the `skip` and `limit` pagination parameters from the query string
+func pageParams(r *http.Request) (skip int, limit int, err error) {
+	q := r.URL.Query()
+	limit = defaultPageLimit
+	if s := q.Get("skip"); s != "" {
+		if skip, err = strconv.Atoi(s); err != nil || skip < 0 {
+			return 0, 0, errors.New("skip must be a non-negative integer")
+		}
+	}
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+	}
+	return skip, limit, nil
+}
+
+// Generate a random id for nodes created by the server
+func newId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("Err in newId: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
 // read the request body and format it
-func getReqBody(r *http.Request) (string, error) {
-	b := make([]byte, 300)
-	n, err := r.Body.Read(b)
-	if err != nil && err != io.EOF {
+func getReqBody(w http.ResponseWriter, r *http.Request) (string, error) {
+	b, err := readBody(w, r)
+	if err != nil {
 		return "", err
 	}
-	return formatToNeoJson(string(b[:n])), nil
+	return formatToNeoJson(string(b)), nil
 }
 
 // Retrieve data field of node returned from neo4j
@@ -39,9 +83,76 @@ func getAuthorData(v interface{}) (interface{}, error) {
 		return nil, errors.New("interface of *[]Post expected")
 	}
 	for i, _ := range *res {
-		// get the `data` field
-		d := (*res)[i].Author["data"]
-		(*res)[i].Author = d.(map[string]interface{})
+		// get the `data` field, results of a transaction have none and
+		// hold the properties directly
+		if d, ok := (*res)[i].Author["data"].(map[string]interface{}); ok {
+			(*res)[i].Author = d
+		}
 	}
 	return *res, nil
 }
+
+// Get the versions listed in the `If-Match` header. nil means no
+// precondition: the header is absent or `*`. ETags that are not ours
+// are skipped, so they never match.
+func parseIfMatch(r *http.Request) []int {
+	header := r.Header.Get("If-Match")
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return nil
+	}
+	versions := []int{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if v, err := strconv.Atoi(strings.Trim(tag, `"`)); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// Set the ETag header for a node at `version`
+func setETag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, version))
+}
+
+// Get the version of the node labelled `label` with id `id`.
+// `found` is false if there is no such node.
+func nodeVersion(context *AppContext, label string, id string) (version int, found bool, err error) {
+	findVersion := `
+		MATCH (n:` + label + ` {id:{id}})
+		RETURN coalesce(n.version, 0) as version
+	`
+	queryReqFindVersion := QueryRequest{
+		Name: "find-node-version",
+		Result: &[]struct {
+			Version int `json:"version"`
+		}{},
+		Query: MakeQuery(findVersion, Props{"id": id}, nil),
+	}
+
+	result := QueryResult{}
+	err = context.DB.RunSingleQuery(queryReqFindVersion, &result)
+	if err != nil {
+		return 0, false, err
+	}
+	rows := *result.Result.(*[]struct {
+		Version int `json:"version"`
+	})
+	if len(rows) == 0 {
+		return 0, false, nil
+	}
+	return rows[0].Version, true, nil
+}
+
+// Work out why a conditional update matched nothing: 404 when the node
+// is gone, 412 when it has moved on from the version in `If-Match`.
+func preconditionStatus(context *AppContext, label string, id string) (int, error) {
+	version, found, err := nodeVersion(context, label, id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !found {
+		return http.StatusNotFound, NotFound(strings.ToLower(label))
+	}
+	return http.StatusPreconditionFailed, PreconditionFailed(fmt.Sprintf("version mismatch, current version is %d", version))
+}
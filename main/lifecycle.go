@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// A context canceled on SIGINT or SIGTERM
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// Run `server` until `ctx` is done, then stop accepting connections and
+// give in-flight requests `timeout` to finish. `cleanups` run in order
+// once the server has stopped, whether it drained in time or not.
+func serve(ctx context.Context, server *http.Server, timeout time.Duration, cleanups ...func()) error {
+	errc := make(chan error, 1)
+	go func() {
+		slog.Info("listening", "addr", server.Addr)
+		errc <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down, waiting for requests to finish", "timeout", timeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("shutdown failed", "err", err)
+		server.Close()
+	}
+	for _, cleanup := range cleanups {
+		cleanup()
+	}
+	return err
+}
+
+// A cleanup exporting the spans still buffered by the tracer provider
+func flushTraces(shutdown func(context.Context) error) func() {
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			slog.Error("flush traces failed", "err", err)
+		}
+	}
+}
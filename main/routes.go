@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/leozhucong/wok-go-neo4j/app"
+)
+
+// Registers routes on the router and remembers them, Ex. "GET /posts/:id",
+// for the OpenAPI document
+type routeTable struct {
+	router *httprouter.Router
+	routes []string
+}
+
+func (t *routeTable) Handle(method string, path string, handle routeHandle) {
+	t.router.Handle(method, path, handle(path))
+	t.routes = append(t.routes, method+" "+path)
+}
+
+func (t *routeTable) GET(path string, handle routeHandle) {
+	t.Handle("GET", path, handle)
+}
+
+func (t *routeTable) POST(path string, handle routeHandle) {
+	t.Handle("POST", path, handle)
+}
+
+func (t *routeTable) PUT(path string, handle routeHandle) {
+	t.Handle("PUT", path, handle)
+}
+
+func (t *routeTable) PATCH(path string, handle routeHandle) {
+	t.Handle("PATCH", path, handle)
+}
+
+func (t *routeTable) DELETE(path string, handle routeHandle) {
+	t.Handle("DELETE", path, handle)
+}
+
+// Remember `paths` served by the handler of another route, see byParam
+func (t *routeTable) Dispatched(method string, paths ...string) {
+	for _, path := range paths {
+		t.routes = append(t.routes, method+" "+path)
+	}
+}
+
+// Serve static routes like `POST /posts/query` from the wildcard route
+// `path`, Ex. "/posts/:id", by the value of param `name`, see byParam.
+// httprouter refuses them next to routes under the wildcard, like
+// `POST /posts/:id/report`. Other values of the param are not found.
+func (t *routeTable) Static(method string, path string, name string, handles map[string]routeHandle) {
+	t.router.Handle(method, path, byParam(name, handles, notFound)(path))
+	var values []string
+	for value := range handles {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		t.routes = append(t.routes, method+" "+strings.Replace(path, ":"+name, value, 1))
+	}
+}
+
+// Answers 404 like the router does for paths it has no route for
+func notFound(route string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		app.WriteError(w, r, http.StatusNotFound, app.NotFound("route"))
+	}
+}
+
+// The router serving every route of the API with the app `context`
+func newRouter(context *app.AppContext) *routeTable {
+	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.WriteError(w, r, http.StatusNotFound, app.NotFound("route"))
+	})
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.WriteError(w, r, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	})
+	router.PanicHandler = func(w http.ResponseWriter, r *http.Request, v interface{}) {
+		app.WriteError(w, r, http.StatusInternalServerError, fmt.Errorf("panic: %v", v))
+	}
+
+	routes := &routeTable{router: router}
+
+	// health handlers
+	routes.GET("/healthz", makeHandler(context, app.HealthGet))
+	routes.GET("/readyz", makeHandler(context, app.ReadyGet))
+	routes.GET("/version", makeHandler(context, app.VersionGet))
+	routes.GET("/metrics", makeHandler(context, app.MetricsGet))
+
+	// API document handlers
+	routes.GET("/openapi.json", makeHandler(context, app.OpenAPIGet))
+	routes.GET("/docs", makeHandler(context, app.DocsGet))
+
+	// user handlers
+	routes.GET("/users", makeHandler(context, app.UserGetAll))
+	routes.GET("/users/:id", makeHandler(context, app.UserGetOne))
+	routes.Static("POST", "/users/:id", "id", map[string]routeHandle{
+		"query": makeHandler(context, app.UserQuery),
+	})
+	routes.POST("/users", makeHandler(context, app.UserCreate))
+	routes.PUT("/users/:id", makeHandler(context, app.UserUpdate))
+	routes.PATCH("/users/:id", makeHandler(context, app.UserPatch))
+	routes.DELETE("/users/:id", makeHandler(context, app.UserDestroy))
+	routes.GET("/users/:id/votes", makeHandler(context, app.UserGetVotedPosts))
+	routes.PUT("/users/:id/follow", makeHandler(context, app.UserFollow))
+	routes.DELETE("/users/:id/follow", makeHandler(context, app.UserUnfollow))
+	routes.GET("/users/:id/followers", makeHandler(context, app.UserGetFollowers))
+	routes.GET("/users/:id/following", makeHandler(context, app.UserGetFollowing))
+	routes.GET("/users/:id/recommendations", makeHandler(context, app.UserGetRecommendations))
+	routes.GET("/users/:id/mutual/:otherId", makeHandler(context, app.UserGetMutual))
+	routes.GET("/users/:id/recommended-posts", makeHandler(context, app.UserGetRecommendedPosts))
+	routes.PUT("/users/:id/block", makeHandler(context, app.UserBlock))
+	routes.DELETE("/users/:id/block", makeHandler(context, app.UserUnblock))
+	routes.GET("/users/:id/blocks", makeHandler(context, app.UserGetBlocked))
+	routes.PUT("/users/:id/mute", makeHandler(context, app.UserMute))
+	routes.DELETE("/users/:id/mute", makeHandler(context, app.UserUnmute))
+	routes.GET("/users/:id/mutes", makeHandler(context, app.UserGetMuted))
+	routes.GET("/users/:id/saved", makeHandler(context, app.UserGetSaved))
+	routes.POST("/users/:id/report", makeHandler(context, app.UserReport))
+
+	// post handlers
+	routes.GET("/posts", makeHandler(context, app.PostGetAll))
+	routes.GET("/posts/:id", byParam("id", map[string]routeHandle{
+		"hot":      makeHandler(context, app.PostGetHot),
+		"trending": makeHandler(context, app.PostGetTrending),
+	}, makeHandler(context, app.PostGetOne)))
+	routes.Dispatched("GET", "/posts/hot", "/posts/trending")
+	routes.Static("POST", "/posts/:id", "id", map[string]routeHandle{
+		"query": makeHandler(context, app.PostQuery),
+	})
+	routes.POST("/posts", makeHandler(context, app.PostCreate))
+	routes.PUT("/posts/:id", makeHandler(context, app.PostUpdate))
+	routes.PATCH("/posts/:id", makeHandler(context, app.PostPatch))
+	routes.DELETE("/posts/:id", makeHandler(context, app.PostDestroy))
+	routes.PUT("/posts/:id/vote", makeHandler(context, app.PostVote))
+	routes.DELETE("/posts/:id/vote", makeHandler(context, app.PostDeleteVote))
+	routes.GET("/posts/:id/vote", makeHandler(context, app.PostGetVote))
+	routes.POST("/posts/:id/report", makeHandler(context, app.PostReport))
+	routes.PUT("/posts/:id/save", makeHandler(context, app.PostSave))
+	routes.DELETE("/posts/:id/save", makeHandler(context, app.PostUnsave))
+	routes.POST("/posts/:id/publish", makeHandler(context, app.PostPublish))
+	routes.POST("/posts/:id/unpublish", makeHandler(context, app.PostUnpublish))
+	routes.POST("/posts/:id/archive", makeHandler(context, app.PostArchive))
+	routes.GET("/posts/:id/revisions", makeHandler(context, app.PostGetRevisions))
+	routes.GET("/posts/:id/revisions/:rev", makeHandler(context, app.PostGetRevision))
+	routes.GET("/posts/:id/revisions/:rev/diff/:other", makeHandler(context, app.PostDiffRevisions))
+	routes.POST("/posts/:id/revisions/:rev/restore", makeHandler(context, app.PostRestoreRevision))
+
+	// comment handlers
+	routes.GET("/posts/:id/comments", makeHandler(context, app.CommentGetAll))
+	routes.POST("/posts/:id/comments", makeHandler(context, app.CommentCreate))
+	routes.GET("/posts/:id/comments/:cid", makeHandler(context, app.CommentGetOne))
+	routes.PUT("/posts/:id/comments/:cid", makeHandler(context, app.CommentUpdate))
+	routes.DELETE("/posts/:id/comments/:cid", makeHandler(context, app.CommentDestroy))
+	routes.PUT("/posts/:id/comments/:cid/vote", makeHandler(context, app.CommentVote))
+	routes.DELETE("/posts/:id/comments/:cid/vote", makeHandler(context, app.CommentDeleteVote))
+
+	// feed handlers
+	routes.GET("/feed", makeHandler(context, app.FeedGet))
+
+	// tag handlers
+	routes.GET("/tags", makeHandler(context, app.TagGetAll))
+	routes.GET("/tags/:slug/posts", makeHandler(context, app.TagGetPosts))
+	routes.GET("/tags/:slug/related", makeHandler(context, app.TagGetRelated))
+
+	// relation handlers
+	routes.GET("/relation/:id1/:id2/path", makeHandler(context, app.RelationGetPath))
+
+	// graph handlers
+	routes.GET("/graph/:id", makeHandler(context, app.GraphGet))
+
+	// moderation handlers
+	routes.GET("/moderation/reports", makeHandler(context, app.ModerationGetReports))
+	routes.PUT("/moderation/reports/:rid", makeHandler(context, app.ModerationResolveReport))
+	routes.POST("/moderation/posts/:id/hide", makeHandler(context, app.ModerationAct("hide_post")))
+	routes.POST("/moderation/posts/:id/unhide", makeHandler(context, app.ModerationAct("unhide_post")))
+	routes.POST("/moderation/users/:id/suspend", makeHandler(context, app.ModerationAct("suspend_user")))
+	routes.POST("/moderation/users/:id/unsuspend", makeHandler(context, app.ModerationAct("unsuspend_user")))
+
+	return routes
+}
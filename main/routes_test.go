@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/leozhucong/wok-go-neo4j/app"
+)
+
+// The server refuses to start when the routes and the OpenAPI document
+// disagree, catch it before that
+func TestRoutesDocumented(t *testing.T) {
+	routes := newRouter(&app.AppContext{})
+	if err := app.BuildOpenAPI(routes.routes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimitPoliciesMatchRoutes(t *testing.T) {
+	routes := newRouter(&app.AppContext{})
+	config := app.DefaultConfig().RateLimit
+	limiter := app.NewRateLimiter(config, app.NewMemoryRateLimitStore(config.MaxClients))
+	if err := limiter.CheckRoutes(routes.routes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Static segments and wildcards under the same path reach their own
+// handlers, see routeTable.Static
+func TestRouterServes(t *testing.T) {
+	routes := newRouter(&app.AppContext{})
+	for _, c := range []struct {
+		method, path, id string
+	}{
+		{"POST", "/users/query", "query"},
+		{"POST", "/users/u1/report", "u1"},
+		{"POST", "/posts/query", "query"},
+		{"POST", "/posts/p1/report", "p1"},
+		{"POST", "/posts/p1/publish", "p1"},
+		{"POST", "/posts/p1/unpublish", "p1"},
+		{"POST", "/posts/p1/archive", "p1"},
+		{"GET", "/posts/hot", "hot"},
+		{"GET", "/posts/p1", "p1"},
+		{"GET", "/posts/p1/comments", "p1"},
+		{"POST", "/posts/p1/comments", "p1"},
+		{"PUT", "/posts/p1/comments/c1/vote", "p1"},
+	} {
+		handle, ps, _ := routes.router.Lookup(c.method, c.path)
+		if handle == nil {
+			t.Errorf("%s %s: no route", c.method, c.path)
+		} else if id := ps.ByName("id"); id != c.id {
+			t.Errorf("%s %s: id %q, want %q", c.method, c.path, id, c.id)
+		}
+	}
+
+	for _, path := range []string{"/posts/p1", "/nowhere"} {
+		w := httptest.NewRecorder()
+		routes.router.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("POST %s: status %d, want 404", path, w.Code)
+		}
+	}
+}